@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+var (
+	errAdminDisabled = errors.New("admin endpoints are disabled, set -admin-token")
+	errNotAdmin      = errors.New("missing or wrong admin token")
+)
+
+// requireAdmin reject requests without the admin token as bearer token.
+// Every request is rejected if no token is configured.
+func requireAdmin(token string) func(http.Handler) http.Handler {
+	want := sha3.Sum256([]byte(token))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				httpError(w, r, http.StatusForbidden, "error.admin_disabled", errAdminDisabled)
+				return
+			}
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			// Hashes have the same length whatever was sent
+			got := sha3.Sum256([]byte(given))
+			if given == "" || subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				httpError(w, r, http.StatusUnauthorized, "error.not_admin", errNotAdmin)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -17,24 +20,43 @@ import (
 	"github.com/go-chi/render"
 	"github.com/google/uuid"
 	"github.com/ice2heart/proxyu_client/common"
+	"github.com/ice2heart/proxyu_client/dag"
+	"github.com/ice2heart/proxyu_client/l10n"
 
 	pb "github.com/ice2heart/proxyu_client/protocol"
+	spb "github.com/ice2heart/proxyu_client/serialize"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 )
 
 var (
-	keyPath       = flag.String("tls-key", "client.dev.key", "Path to TLS private key")
-	certPath      = flag.String("tls-cert", "client.dev.pem", "Path to TLS certificate (if using TCP)")
-	rootCertPath  = flag.String("tls-ca-cert", "ca.pem", "Path to TLS CA root certificate (if using TCP)")
-	proxyuAddress = flag.String("proxyu", "proxyu:8080", "ProxyU fqdn:port")
-	userDataDB    = flag.String("userdata", "userdata.db", "File to store userdata")
-	processUUID   = flag.String("process", "d31572a0-3799-4391-b3ac-149537a29b38", "UUID of process")
-	dagyml        = flag.String("dag", "didgraph.yml", "Path to dag description file")
-	dagdevyml     = flag.String("dag-dev", "./l10n/dev.yml", "Path to the translation file")
-	serverPort    = flag.Int("port", 8090, "Web server port")
-	dataUUIDs     map[string][]byte
-	proxyuClient  pb.ProxyUIntegrationClient
+	keyPath         = flag.String("tls-key", "client.dev.key", "Path to TLS private key")
+	certPath        = flag.String("tls-cert", "client.dev.pem", "Path to TLS certificate (if using TCP)")
+	rootCertPath    = flag.String("tls-ca-cert", "ca.pem", "Path to TLS CA root certificate (if using TCP)")
+	proxyuAddress   = flag.String("proxyu", "proxyu:8080", "ProxyU fqdn:port")
+	userDataDB      = flag.String("userdata", "userdata.db", "File to store userdata")
+	storageBackend  = flag.String("storage", "bolt", "Storage backend: bolt, postgres, sqlite or memory")
+	storageDSN      = flag.String("storage-dsn", "", "Connection string of the postgres or sqlite backend")
+	masterKeyFile   = flag.String("master-key", "", "File with base64 master keys of the bolt storage, one per line, the first encrypts new data keys. "+masterKeyEnv+" if empty")
+	allowPlaintext  = flag.Bool("allow-plaintext", false, "Store user data unencrypted if no master key is set or the storage does not encrypt")
+	processUUID     = flag.String("process", "d31572a0-3799-4391-b3ac-149537a29b38", "UUID of process")
+	dagyml          = flag.String("dag", "didgraph.yml", "Path to dag description file")
+	dagdevyml       = flag.String("dag-dev", "./l10n/dev.yml", "Path to the translation file")
+	l10nDir         = flag.String("l10n", "./l10n", "Directory with the translation files")
+	defaultLang     = flag.String("lang", "en", "Language used when the client accepts none of the translations")
+	dagReload       = flag.Duration("dag-reload", 5*time.Second, "Interval to check the dag files for changes, 0 to reload on SIGHUP only")
+	permissionsyml  = flag.String("permissions", "permissions.yml", "Path to permission profiles file")
+	partialData     = flag.Bool("partial-data", false, "Answer data requests with the stored part of a node")
+	serverPort      = flag.Int("port", 8090, "Web server port")
+	sessionHashKey  = flag.String("session-hash-key", "", "Base64 key to sign session cookies, 32 or 64 bytes, random if empty")
+	sessionBlockKey = flag.String("session-block-key", "", "Base64 AES key to encrypt session cookies, 16, 24 or 32 bytes, random if empty")
+	sessionMaxAge   = flag.Duration("session-max-age", 30*24*time.Hour, "Session lifetime")
+	sessionSecure   = flag.Bool("session-secure", false, "Send session cookie over HTTPS only, set it when the server is behind a TLS proxy")
+	sessionSweep    = flag.Duration("session-sweep", time.Hour, "Interval to purge expired sessions")
+	historyKeep     = flag.Duration("history-retention", 0, "Keep previous versions of user data this long, 0 keeps them forever")
+	adminToken      = flag.String("admin-token", "", "Bearer token of the /api/admin endpoints, they are disabled if empty")
+	documentHosts   = flag.String("document-hosts", "", "Comma separated hosts policy documents may be fetched from, any public host if empty")
+	proxyuClient    pb.ProxyUIntegrationClient
 )
 
 // Directory contain files for html template
@@ -46,12 +68,10 @@ type AuthStatus struct {
 	Status bool `json:"status" gorm:"not null"`
 }
 
-type dataRequest struct {
-	Request  *pb.DataRequest_RetrieveRequest
-	Response chan *pb.DataField
-}
-
-func main() {
+// serveCmd `serve` web server with the proxyU client, runs until SIGINT or SIGTERM
+func serveCmd(args []string) {
+	parseArgs(newFlagSet("serve", ""), args, 0, 0)
+	logConfig()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer func() {
 		if v := recover(); v != nil {
@@ -59,39 +79,77 @@ func main() {
 		}
 	}()
 
-	flag.Parse()
 	// Parse graph of type of data.
-	ParseDAGYML(dagyml)
-	dataUUIDs = ParseDAGDevYML(dagdevyml)
+	if err := ReloadDAG(); err != nil {
+		logrus.Fatal(err)
+	}
+	go watchDAG(ctx, *dagReload)
+
+	var err error
+	permissionProfiles, err = ParsePermissionsYML(permissionsyml)
+	if err != nil {
+		logrus.Fatalf("permissions: %v", err)
+	}
+	sessionStore, err = newSessionStore(*sessionHashKey, *sessionBlockKey, *sessionMaxAge, *sessionSecure)
+	if err != nil {
+		logrus.Fatalf("sessions: %v", err)
+	}
 
 	// Catch signals and close listener socket
 	intCh := make(chan os.Signal, 1)
 	signal.Notify(intCh, os.Interrupt, syscall.SIGTERM)
 
-	// change to ctx func
-	go OpenDB(userDataDB, intCh)
+	store, err := openStore()
+	if err != nil {
+		logrus.Fatalf("storage: %v", err)
+	}
+	defer store.Close()
+	logrus.Printf("%s storage is open", *storageBackend)
+	if legacy, ok := store.(*BoltStore); ok {
+		n, err := legacy.MigrateLegacyPermissions(common.UUID2bytes(*processUUID), permissionProfiles, time.Now())
+		if err != nil {
+			logrus.Fatalf("migrate permissions: %v", err)
+		}
+		if n > 0 {
+			logrus.Printf("%d permissions of an older version migrated", n)
+		}
+	}
+	go sweepSessions(ctx, store, *sessionSweep)
+	go sweepHistory(ctx, store, *historyKeep)
+	go sweepRetrieved(ctx, store)
 
-	conn, err := grpc.Dial(*proxyuAddress, grpc.WithTransportCredentials(common.LoadTLSKeys(certPath, keyPath, rootCertPath)))
+	conn, err := dialProxyU()
 	if err != nil {
 		logrus.Fatalf("did not connect: %v", err)
 	}
 	defer conn.Close()
 	proxyuClient = pb.NewProxyUIntegrationClient(conn)
 
-	dataProcessingChanel := make(chan *dataRequest)
-	go dataProcessing(ctx, cancel, proxyuClient, dataProcessingChanel)
+	retrievals := newCorrelator()
+	go dataProcessing(ctx, cancel, store, proxyuClient, retrievals)
 
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Route("/api", func(r chi.Router) {
 		// r.Post("/login", createArticle)                                        // POST /articles
-		r.Get("/login", getLogin) // GET /articles/search
-		r.Get("/auth", HandleAuth(proxyuClient))
-		r.Get("/request/{id:[0-9a-f-]+}", HandleRequest(proxyuClient))
+		r.Get("/login", makeGetLogin(store)) // GET /articles/search
+		r.Post("/logout", makePostLogout(store))
+		r.With(withSession(store)).Get("/auth", HandleAuth(store, proxyuClient))
+		r.With(requireAuth(store)).Get("/request/{id:[0-9A-Za-z_-]+}", HandleRequest(store, proxyuClient))
 		r.Get("/dag", getDAG)
+		r.Get("/export/schema", getExportSchema)
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(requireAdmin(*adminToken))
+			r.Get("/documents", makeGetDocuments(store))
+			r.Post("/documents", makePostDocument(store, proxyuClient))
+			r.Post("/sessions/revoke", makePostRevokeSessions(store))
+		})
 		r.Route("/user", func(r chi.Router) {
-			r.Get("/permissions", makeGetPermission(dataProcessingChanel))
+			r.Use(requireAuth(store))
+			r.Get("/permissions", makeGetPermission(store, retrievals))
+			r.Get("/data/{id:[0-9A-Za-z_-]+}/history", makeGetHistory(store))
+			r.Get("/export", makeGetExport(store))
 		})
 	})
 
@@ -118,20 +176,36 @@ func main() {
 
 }
 
+func dialProxyU() (*grpc.ClientConn, error) {
+	return grpc.Dial(*proxyuAddress, grpc.WithTransportCredentials(common.LoadTLSKeys(certPath, keyPath, rootCertPath)))
+}
+
 type CorrellationMessage struct {
 	Done    bool   `json:"done"`
 	Message string `json:"msg"`
 	Pubkey  string `json:"-"`
 }
 
-func HandleAuth(client pb.ProxyUIntegrationClient) http.HandlerFunc {
+func HandleAuth(store Store, client pb.ProxyUIntegrationClient) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("userUUID")
+		// The cookie with the id of the correlated session goes out with the
+		// events. The old session is removed once the correlation succeeded,
+		// otherwise it is carried over to the new id.
+		oldUUID := sessionFrom(r.Context()).ID
+		userUUID, err := startSession(w, r)
 		if err != nil {
-			logrus.Panic(err)
+			httpError(w, r, http.StatusInternalServerError, "error.internal", err)
+			return
 		}
-		var userUUID [16]byte
-		copy(userUUID[:], common.S2B(cookie.Value))
+		correlated := false
+		defer func() {
+			if correlated {
+				return
+			}
+			if err := moveSession(store, &oldUUID, &userUUID); err != nil {
+				logrus.Errorf("Failed to keep session: %v", err)
+			}
+		}()
 
 		ctx := r.Context()
 		h := w.Header()
@@ -157,6 +231,15 @@ func HandleAuth(client pb.ProxyUIntegrationClient) http.HandlerFunc {
 				return
 			}
 			defer stream.CloseSend()
+			// The reader stops once the browser is gone
+			send := func(msg CorrellationMessage) bool {
+				select {
+				case data <- msg:
+					return true
+				case <-ctx.Done():
+					return false
+				}
+			}
 
 			for {
 				in, err := stream.Recv()
@@ -165,15 +248,21 @@ func HandleAuth(client pb.ProxyUIntegrationClient) http.HandlerFunc {
 					return
 				}
 				if err != nil {
-					logrus.Error("HandleAuth Failed to receive a note : %v", err)
+					logrus.Errorf("HandleAuth Failed to receive a note : %v", err)
 					return
 				}
 				// use struct
+				var msg CorrellationMessage
 				switch u := in.GetResponse().(type) {
 				case *pb.CorrelationResponse_CorrelationMessage:
-					data <- CorrellationMessage{Message: u.CorrelationMessage, Done: false, Pubkey: ""}
+					msg = CorrellationMessage{Message: u.CorrelationMessage, Done: false, Pubkey: ""}
 				case *pb.CorrelationResponse_PublicKey:
-					data <- CorrellationMessage{Message: "", Done: true, Pubkey: common.B2S(u.PublicKey)}
+					msg = CorrellationMessage{Message: "", Done: true, Pubkey: common.B2S(u.PublicKey)}
+				default:
+					continue
+				}
+				if !send(msg) {
+					return
 				}
 			}
 
@@ -195,7 +284,14 @@ func HandleAuth(client pb.ProxyUIntegrationClient) http.HandlerFunc {
 				if d.Done {
 					var pubKey [32]byte
 					copy(pubKey[:], common.S2B(d.Pubkey))
-					WriteSession(&userUUID, &pubKey)
+					if err := store.WriteSession(&userUUID, &pubKey, sessionExpires()); err != nil {
+						logrus.Errorf("Failed to store session: %v", err)
+					} else {
+						correlated = true
+						if err := store.DeleteSession(&oldUUID); err != nil {
+							logrus.Errorf("Failed to remove session: %v", err)
+						}
+					}
 					logrus.Info("Pubkey ", d.Pubkey)
 				}
 				io.WriteString(w, "data: ")
@@ -210,15 +306,14 @@ func HandleAuth(client pb.ProxyUIntegrationClient) http.HandlerFunc {
 	}
 }
 
-func HandleRequest(client pb.ProxyUIntegrationClient) http.HandlerFunc {
+func HandleRequest(store Store, client pb.ProxyUIntegrationClient) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("userUUID")
+		pubKey := sessionFrom(r.Context()).PubKey
+		policy, err := CurrentPolicyHash(store)
 		if err != nil {
-			logrus.Panic(err)
+			httpError(w, r, http.StatusPreconditionFailed, "error.no_policy", err)
+			return
 		}
-		var userUUID [16]byte
-		copy(userUUID[:], common.S2B(cookie.Value))
-		pubKey := GetSession(&userUUID)
 		ctx := r.Context()
 		h := w.Header()
 		h.Set("Content-Type", "text/event-stream")
@@ -231,39 +326,38 @@ func HandleRequest(client pb.ProxyUIntegrationClient) http.HandlerFunc {
 			return
 		}
 
-		// ToDo: make params
-		logrus.Info("Pubkey", pubKey)
-		dataID := chi.URLParam(r, "id")
-		// dataType := "NAME"
-		reason := common.UUID2bytes("323fd1ea-76c7-4069-8fb1-d223f816c927")
-		// User real hash
-		policy := common.S2B("zqNzKjKy2SUf4SR+dGlLeBfHKaCWPBc6jKANOOM5XAY=")
-		from := uint64(1605087413)
-		until := uint64(1893456000)
-		amount := uint32(0)
-		level := uint32(1)
-		message := &pb.PermissionRequest{
-			Amount: amount,
-			// Data:      dataUUIDs[dataType],
-			Data:      common.UUID2bytes(dataID),
-			From:      from,
-			Level:     level,
-			Policy:    policy,
-			Process:   common.UUID2bytes(*processUUID),
-			PublicKey: pubKey,
-			Reason:    reason,
-			Until:     until,
+		logrus.Info("Pubkey ", common.B2S(pubKey[:]))
+		dataID, err := ParseDataID(chi.URLParam(r, "id"))
+		if err != nil {
+			httpError(w, r, http.StatusNotFound, "error.unknown_data", err)
+			return
+		}
+		dataUUID := [16]byte(dataID)
+		params, err := permissionProfiles.Get(&dataUUID).Params(r.URL.Query(), time.Now())
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, "error.permission_params", err)
+			return
 		}
+		message := newPermissionRequest(pubKey, &dataUUID, policy, params)
 
 		data := make(chan CorrellationMessage)
 		go func(globalCtx context.Context, message *pb.PermissionRequest, data chan CorrellationMessage) {
+			defer close(data)
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
 			stream, err := client.Permission(ctx, message)
 			if err != nil {
-				logrus.Panic(err)
+				logrus.Errorf("Permission request failed: %v", err)
+				return
 			}
 			defer stream.CloseSend()
+			// The browser may be gone, the grant is still stored
+			send := func(msg CorrellationMessage) {
+				select {
+				case data <- msg:
+				case <-globalCtx.Done():
+				}
+			}
 			for {
 				in, err := stream.Recv()
 				if err == io.EOF {
@@ -271,21 +365,19 @@ func HandleRequest(client pb.ProxyUIntegrationClient) http.HandlerFunc {
 					return
 				}
 				if err != nil {
-					logrus.Fatalf("Failed to receive a note : %v", err)
+					logrus.Errorf("Failed to receive a permission response: %v", err)
 					return
 				}
 				switch u := in.GetResponse().(type) {
 				case *pb.PermissionResponse_Granted:
-					var empty [1]byte
-					s := "Empty"
-					var key [32]byte
-					var d [16]byte
-					copy(key[:], message.PublicKey)
-					copy(d[:], message.Data)
-					WriteUserData(&key, &d, &s, empty[:])
-					data <- CorrellationMessage{Message: "", Done: u.Granted, Pubkey: ""}
+					if u.Granted {
+						if err := store.WritePermission(grantedPermission(message, time.Now())); err != nil {
+							logrus.Errorf("Failed to store permission: %v", err)
+						}
+					}
+					send(CorrellationMessage{Message: "", Done: u.Granted, Pubkey: ""})
 				case *pb.PermissionResponse_PermissionMessage:
-					data <- CorrellationMessage{Message: u.PermissionMessage, Done: false, Pubkey: ""}
+					send(CorrellationMessage{Message: u.PermissionMessage, Done: false, Pubkey: ""})
 				}
 			}
 		}(ctx, message, data)
@@ -317,53 +409,146 @@ func HandleRequest(client pb.ProxyUIntegrationClient) http.HandlerFunc {
 	}
 }
 
-func getLogin(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("userUUID")
-	if err != nil || cookie.Value == "" {
-		expiration := time.Now().Add(365 * 24 * time.Hour)
-		newUUID := common.RandomUUID()
-		cookie = &http.Cookie{Name: "userUUID", Value: common.B2S(newUUID), Expires: expiration}
+// newPermissionRequest request of the data for the process of this client
+func newPermissionRequest(pubKey *[32]byte, dataUUID *[16]byte, policy []byte, params permissionParams) *pb.PermissionRequest {
+	return &pb.PermissionRequest{
+		Amount:    params.Amount,
+		Data:      dataUUID[:],
+		From:      params.From,
+		Level:     params.Level,
+		Policy:    policy,
+		Process:   common.UUID2bytes(*processUUID),
+		PublicKey: pubKey[:],
+		Reason:    params.Reason,
+		Until:     params.Until,
 	}
-	var userUUID [16]byte
-	copy(userUUID[:], common.S2B(cookie.Value))
-	session := GetSession(&userUUID)
-	if session != nil {
-		logrus.Info("authenticated")
-		w.WriteHeader(http.StatusOK)
-		status := AuthStatus{Status: true}
-		http.SetCookie(w, cookie)
-		render.JSON(w, r, status)
-		return
+}
+
+// grantedPermission permission to store once the subject granted the request
+func grantedPermission(message *pb.PermissionRequest, now time.Time) *spb.Permission {
+	return &spb.Permission{
+		PublicKey: message.PublicKey,
+		Data:      message.Data,
+		Process:   message.Process,
+		Reason:    message.Reason,
+		Policy:    message.Policy,
+		From:      message.From,
+		Until:     message.Until,
+		Amount:    message.Amount,
+		Granted:   now.Unix(),
+	}
+}
+
+func makeGetLogin(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, err := getSessionID(r)
+		if err != nil {
+			userUUID, err = startSession(w, r)
+			if err != nil {
+				httpError(w, r, http.StatusInternalServerError, "error.internal", err)
+				return
+			}
+		}
+		if store.GetSession(&userUUID) != nil {
+			logrus.Info("authenticated")
+			render.Status(r, http.StatusOK)
+			render.JSON(w, r, AuthStatus{Status: true})
+			return
+		}
+		render.Status(r, http.StatusAccepted)
+		render.JSON(w, r, AuthStatus{Status: false})
 	}
-	http.SetCookie(w, cookie)
-	w.WriteHeader(http.StatusAccepted)
-	status := AuthStatus{Status: false}
-	render.JSON(w, r, status)
+}
+
+type dagMessage struct {
+	DAGYAML
+	Version  uint64
+	Language string
 }
 
 func getDAG(w http.ResponseWriter, r *http.Request) {
-	render.JSON(w, r, daggraph)
+	state := currentDAG()
+	t := requestTranslation(r)
+	msg := dagMessage{Version: state.Version}
+	for _, node := range state.YAML.Didgraph {
+		id, err := uuid.Parse(node.Key)
+		if label, ok := t.Label(id); err == nil && ok {
+			node.Description = label
+		}
+		msg.Didgraph = append(msg.Didgraph, node)
+	}
+	if t != nil {
+		msg.Language = t.Tag.String()
+		w.Header().Set("Content-Language", msg.Language)
+	}
+	render.JSON(w, r, msg)
+}
+
+// requestTranslation language negotiated from the lang parameter and Accept-Language header
+func requestTranslation(r *http.Request) *l10n.Translation {
+	return currentDAG().L10n.Match(r.URL.Query().Get("lang"), r.Header.Get("Accept-Language"))
+}
+
+type errorMessage struct {
+	Error  string `json:"error"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// httpError reply with JSON error, message is translated by key
+func httpError(w http.ResponseWriter, r *http.Request, status int, key string, err error) {
+	msg := errorMessage{Error: http.StatusText(status)}
+	if err != nil {
+		msg.Detail = err.Error()
+	}
+	t := requestTranslation(r)
+	if text, ok := t.Message(key); ok {
+		msg.Error = text
+	}
+	if t != nil {
+		w.Header().Set("Content-Language", t.Tag.String())
+	}
+	render.Status(r, status)
+	render.JSON(w, r, msg)
 }
 
+// Status of a data item on the permissions page
+const (
+	statusNoPermission   int32 = 0
+	statusLocal          int32 = 1
+	statusRemote         int32 = 2
+	statusExpired        int32 = 3
+	statusExhausted      int32 = 4
+	statusNotYetValid    int32 = 5
+	statusRetrieveFailed int32 = 6
+)
+
 type permissionMessage struct {
-	Status int32  `json:"status"`
-	Value  []byte `json:"value, string"`
+	Status    int32  `json:"status"`
+	Value     []byte `json:"value"`
+	Until     uint64 `json:"until,omitempty"`
+	Remaining uint32 `json:"remaining,omitempty"`
+	Error     string `json:"error,omitempty"`
 }
 
-func makeGetPermission(dataReq chan *dataRequest) func(w http.ResponseWriter, r *http.Request) {
+// retrieval data of a permission fetched for the permissions page
+type retrieval struct {
+	perm   *spb.Permission
+	id     string
+	fields []*pb.DataField
+	err    error
+}
+
+// retrieveTimeout how long the web client waits for data from proxyU
+const retrieveTimeout = 30 * time.Second
+
+func makeGetPermission(store Store, retrievals *correlator) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// var data map[string]permissionMessage
-		cookie, err := r.Cookie("userUUID")
+		pubKey := *sessionFrom(r.Context()).PubKey
+		records, err := store.GetAllUserData(&pubKey)
 		if err != nil {
-			logrus.Panic(err)
-		}
-		var userUUID [16]byte
-		copy(userUUID[:], common.S2B(cookie.Value))
-		var pubKey [32]byte
-		copy(pubKey[:], GetSession(&userUUID))
-		records, err := GetAllUserData(&pubKey)
-		if err != nil {
-			logrus.Panic(err)
+			httpError(w, r, http.StatusInternalServerError, "error.internal", err)
+			return
 		}
 		data := make(map[string]permissionMessage)
 		for _, record := range records {
@@ -371,29 +556,78 @@ func makeGetPermission(dataReq chan *dataRequest) func(w http.ResponseWriter, r
 			if err != nil {
 				logrus.Error(err)
 			}
-			status := 1
 			logrus.Printf("uuid %v - %s", record, u.String())
-			data[u.String()] = permissionMessage{Status: int32(status), Value: record.Value}
-			if record.Mime == "Empty" {
-				status = 0
-				req := &pb.DataRequest_RetrieveRequest{
-					RetrieveRequest: &pb.DataRetrieveRequest{
-						Data:      record.Data[:],
-						Process:   common.UUID2bytes(*processUUID),
-						PublicKey: pubKey[:],
-					},
-				}
-				resp := make(chan *pb.DataField)
-				r := &dataRequest{Request: req, Response: resp}
-				dataReq <- r
-				for msg := range resp {
-					logrus.Info("Get msg")
-					u, _ := uuid.FromBytes(msg.Uuid)
-					data[u.String()] = permissionMessage{Status: 2, Value: msg.GetValue()}
-				}
-				logrus.Info("Message end")
+			data[u.String()] = permissionMessage{Status: statusLocal, Value: record.Value}
+		}
+
+		perms, err := store.GetAllPermissions(&pubKey)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, "error.internal", err)
+			return
+		}
+		var pending []*retrieval
+		for _, perm := range perms {
+			u, err := uuid.FromBytes(perm.GetData())
+			if err != nil {
+				logrus.Error(err)
+				continue
+			}
+			// Only a successful retrieval counts, it is checked again when it is counted
+			if err := CheckPermission(perm, time.Now()); err != nil {
+				logrus.Printf("Permission %s: %v", u.String(), err)
+				data[u.String()] = permissionMessage{Status: permissionStatus(err), Until: perm.GetUntil()}
+				continue
 			}
+			pending = append(pending, &retrieval{perm: perm, id: u.String()})
+		}
 
+		// All retrievals run at once within one deadline
+		ctx, cancel := context.WithTimeout(r.Context(), retrieveTimeout)
+		defer cancel()
+		var wg sync.WaitGroup
+		for _, rt := range pending {
+			wg.Add(1)
+			go func(rt *retrieval) {
+				defer wg.Done()
+				rt.fields, rt.err = retrievals.Retrieve(ctx, &pb.DataRetrieveRequest{
+					Data:      rt.perm.GetData(),
+					Process:   common.UUID2bytes(*processUUID),
+					PublicKey: pubKey[:],
+				})
+			}(rt)
+		}
+		wg.Wait()
+
+		for _, rt := range pending {
+			perm := rt.perm
+			if rt.err != nil {
+				logrus.Errorf("Retrieve %s failed: %v", rt.id, rt.err)
+				msg := permissionMessage{Status: statusRetrieveFailed, Until: perm.GetUntil(), Error: rt.err.Error()}
+				if text, ok := requestTranslation(r).Message("error.retrieve_failed"); ok {
+					msg.Error = text
+				}
+				data[rt.id] = msg
+				continue
+			}
+			var dataUUID [16]byte
+			copy(dataUUID[:], perm.GetData())
+			used, err := store.UsePermission(&pubKey, &dataUUID, time.Now())
+			if err != nil {
+				logrus.Printf("Permission %s: %v", rt.id, err)
+				data[rt.id] = permissionMessage{Status: permissionStatus(err), Until: perm.GetUntil()}
+				continue
+			}
+			perm = used
+			if err := recordRetrieved(store, &pubKey, rt.fields, common.UUID2bytes(*processUUID)); err != nil {
+				logrus.Errorf("Failed to record retrieved %s: %v", rt.id, err)
+			}
+			data[rt.id] = permissionMessage{Status: statusRemote, Until: perm.GetUntil(), Remaining: perm.GetRemaining()}
+			for _, msg := range rt.fields {
+				logrus.Info("Get msg")
+				u, _ := uuid.FromBytes(msg.Uuid)
+				data[u.String()] = permissionMessage{Status: statusRemote, Value: msg.GetValue(), Until: perm.GetUntil(), Remaining: perm.GetRemaining()}
+			}
+			logrus.Info("Message end")
 		}
 
 		// data["ab493ade-2f3f-11eb-a11b-23fff9ac0d99"] = permissionMessage{Status: 1, Value: []byte("Albert")}
@@ -401,61 +635,201 @@ func makeGetPermission(dataReq chan *dataRequest) func(w http.ResponseWriter, r
 	}
 }
 
-func dataProcessing(globCtx context.Context, globCancel context.CancelFunc, client pb.ProxyUIntegrationClient, dataReq chan *dataRequest) {
+// recordRetrieved keep values retrieved from a remote client in the history of
+// the subject's data. They never replace the current values and are erased once
+// the permission ends. Values which did not change are not written again.
+func recordRetrieved(store Store, pubKey *[32]byte, fields []*pb.DataField, process []byte) error {
+	var writes []UserDataWrite
+	for _, field := range fields {
+		var dataUUID [16]byte
+		if len(field.GetUuid()) != len(dataUUID) {
+			continue
+		}
+		copy(dataUUID[:], field.GetUuid())
+		if !IsDAGLeaf(&dataUUID) {
+			logrus.Printf("Retrieved %v is not a leaf", DataID(dataUUID))
+			continue
+		}
+		versions, err := store.GetUserDataHistory(pubKey, &dataUUID)
+		if err != nil {
+			return err
+		}
+		if last := lastRetrieved(versions); last != nil && last.Mime == field.GetMime() && bytes.Equal(last.Value, field.GetValue()) {
+			continue
+		}
+		writes = append(writes, UserDataWrite{
+			Subject: *pubKey,
+			Data:    dataUUID,
+			Mime:    field.GetMime(),
+			Value:   field.GetValue(),
+			Source:  spb.DataSource_RETRIEVE,
+			Process: process,
+		})
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	return store.AppendUserDataHistory(writes)
+}
+
+// lastRetrieved latest retrieved version, nil if there is none
+func lastRetrieved(versions []UserData) *UserData {
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Source == spb.DataSource_RETRIEVE {
+			return &versions[i]
+		}
+	}
+	return nil
+}
+
+// permissionStatus status of a permission which can not be used
+func permissionStatus(err error) int32 {
+	switch {
+	case errors.Is(err, ErrPermissionExpired):
+		return statusExpired
+	case errors.Is(err, ErrPermissionExhausted):
+		return statusExhausted
+	case errors.Is(err, ErrPermissionNotYetValid):
+		return statusNotYetValid
+	}
+	return statusNoPermission
+}
+
+// extractFields stored leaves of the data item. Missing leaves are ErrDataNotFound
+// unless partial responses are enabled, then only all of them missing is. Other
+// storage errors are returned as they are and reported as internal errors.
+func extractFields(store Store, pubKey *[32]byte, dataUUID *[16]byte) ([]*pb.DataField, error) {
+	leaves, err := GetDAGLeaves(dataUUID)
+	if errors.Is(err, dag.ErrUnknownNode) {
+		return nil, ErrDataNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]*pb.DataField, 0, len(leaves))
+	for _, leaf := range leaves {
+		value, mime, err := store.ExtractUserData(pubKey, &leaf)
+		if err != nil && !errors.Is(err, ErrDataNotFound) {
+			return nil, err
+		}
+		if err != nil {
+			logrus.Printf("No user data for %v", DataID(leaf))
+			if !*partialData {
+				return nil, ErrDataNotFound
+			}
+			continue
+		}
+		leafUUID := leaf // without copy for all fields will be a copy of last slice.
+		fields = append(fields, &pb.DataField{
+			Mime:  mime,
+			Uuid:  leafUUID[:],
+			Value: value,
+		})
+	}
+	if len(fields) == 0 {
+		return nil, ErrDataNotFound
+	}
+	return fields, nil
+}
+
+const (
+	dataStreamMinBackoff = time.Second
+	dataStreamMaxBackoff = time.Minute
+)
+
+// errDataStreamClosed reported to retrievals in flight when the stream is lost
+var errDataStreamClosed = errors.New("data stream closed")
+
+// dataProcessing keep the Data stream open, reconnecting with exponential backoff
+func dataProcessing(globCtx context.Context, globCancel context.CancelFunc, store Store, client pb.ProxyUIntegrationClient, retrievals *correlator) {
 	defer func() {
 		if v := recover(); v != nil {
 			globCancel()
 		}
 	}()
+	backoff := dataStreamMinBackoff
+	for {
+		started := time.Now()
+		err := runDataStream(globCtx, store, client, retrievals)
+		if globCtx.Err() != nil {
+			return
+		}
+		if time.Since(started) > dataStreamMaxBackoff {
+			backoff = dataStreamMinBackoff
+		}
+		logrus.Errorf("Data stream lost: %v, reconnect in %v", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-globCtx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > dataStreamMaxBackoff {
+			backoff = dataStreamMaxBackoff
+		}
+	}
+}
+
+// runDataStream serve one Data stream until it is closed
+func runDataStream(globCtx context.Context, store Store, client pb.ProxyUIntegrationClient, retrievals *correlator) (streamErr error) {
 	logrus.Info("Prepare data")
 	ctx, cancel := context.WithCancel(globCtx)
 	defer cancel()
 	stream, err := client.Data(ctx)
 	if err != nil {
-		logrus.Panic(err)
+		return err
+	}
+	// The stream is opened with a nop request
+	err = stream.Send(&pb.DataRequest{Request: &pb.DataRequest_NopRequest{NopRequest: &pb.DataNopRequest{}}})
+	if err != nil {
+		return err
 	}
 
-	respChan := make(map[[48]byte]chan *pb.DataField)
+	defer retrievals.FailAll(errDataStreamClosed)
+	// gRPC streams do not allow concurrent Send
+	var sendMu sync.Mutex
+	send := func(msg *pb.DataRequest) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.Send(msg)
+	}
 	waitChanel := make(chan struct{})
 	go func() {
+		defer close(waitChanel)
+		// reply answer a request of proxyU, the stream is given up if it fails
+		reply := func(msg *pb.DataRequest) bool {
+			if err := send(msg); err != nil {
+				logrus.Errorf("Failed to send a response: %v", err)
+				streamErr = err
+				return false
+			}
+			return true
+		}
 		for {
 			in, err := stream.Recv()
 			if err == io.EOF {
 				// read done.
 				logrus.Info("EOF")
-				close(waitChanel)
+				streamErr = err
 				return
 			}
 			if err != nil {
-				logrus.Fatalf("Failed to receive a message : %v", err)
-				close(waitChanel)
+				logrus.Errorf("Failed to receive a message : %v", err)
+				streamErr = err
 				return
 			}
 			switch u := in.GetResponse().(type) {
 			case *pb.DataResponse_RetrieveResponse:
 				{
-					if u.RetrieveResponse.GetError() != 0 {
-						continue
-					}
-					values := ""
-
-					line := fmt.Sprintf("%v %v", common.Bytes2uuid(u.RetrieveResponse.GetData()), values)
-					// вот тут надо вытащить ответный канал и положить туда данные
-
-					logrus.Println("Retrive data", line)
-					var key [48]byte
-					copy(key[:], u.RetrieveResponse.PublicKey)
-					copy(key[32:], u.RetrieveResponse.Data)
-
+					key := correlationKey(u.RetrieveResponse.GetPublicKey(), u.RetrieveResponse.GetData())
+					err := pb.ErrorFromCode(u.RetrieveResponse.GetError())
+					logrus.Printf("Retrive data %v %v", dataIDOf(u.RetrieveResponse.GetData()), err)
 					for _, f := range u.RetrieveResponse.GetFields() {
 						logrus.Printf("Get fields %v", f)
-						respChan[key] <- f
-						logrus.Info(f)
 					}
-
-					close(respChan[key])
-					delete(respChan, key)
-
+					if !retrievals.Resolve(key, u.RetrieveResponse.GetFields(), err) {
+						logrus.Printf("Unexpected retrieve response %v", dataIDOf(u.RetrieveResponse.GetData()))
+					}
 				}
 			case *pb.DataResponse_RetrieveRequest:
 				{
@@ -465,48 +839,24 @@ func dataProcessing(globCtx context.Context, globCancel context.CancelFunc, clie
 					copy(dataUUID[:], u.RetrieveRequest.GetData())
 					var process [16]byte
 					copy(process[:], u.RetrieveRequest.GetProcess())
-					data, mime := ExtractUserData(&pubKey, &dataUUID)
-					if data == nil {
-						// FOR DEBUG PURPURE
-						res := []byte("NONE")
-						data = make([]byte, len(res))
-						copy(data, res)
-						mime = "application/datau+node"
-					}
-					childrenID := GetDAGChildren(&dataUUID)
-					var fields []*pb.DataField
-					fields = make([]*pb.DataField, 0)
-					for _, child := range childrenID {
-						chdata, chmime := ExtractUserData(&pubKey, &child)
-						logrus.Printf("Extracted user data: Mime: %v, uuid: %v, value: %v", chmime, common.Bytes2uuid(child[:]), chdata)
-						if chdata == nil {
-							// FOR DEBUG PURPURE
-							res := []byte("NONE")
-							chdata = make([]byte, len(res))
-							copy(chdata, res)
-							chmime = "text/plain; charset=UTF-8"
-							logrus.Printf("Placeholder for user data: Mime: %v, uuid: %v, value: %v", chmime, common.Bytes2uuid(child[:]), chdata)
-						}
-						chuuid := child // without copy for all fields will be a copy of last slice.
-						fields = append(fields, &pb.DataField{
-							Mime:  chmime,
-							Uuid:  chuuid[:],
-							Value: chdata,
-						})
+					fields, err := extractFields(store, &pubKey, &dataUUID)
+					if err != nil {
+						logrus.Printf("DataResponse_RetrieveRequest %v: %v", DataID(dataUUID), err)
 					}
-					logrus.Printf("DataResponse_RetrieveRequest data is extracted %v %v", mime, data)
-					stream.Send(&pb.DataRequest{
+					ok := reply(&pb.DataRequest{
 						Request: &pb.DataRequest_RetrieveResponse{
 							RetrieveResponse: &pb.DataRetrieveResponse{
 								Data:      dataUUID[:],
-								Error:     0,
+								Error:     pb.CodeFromError(err),
 								Fields:    fields,
 								Process:   process[:],
 								PublicKey: pubKey[:],
 							},
 						},
 					})
-
+					if !ok {
+						return
+					}
 				}
 			case *pb.DataResponse_SupplyRequest:
 				{
@@ -517,51 +867,73 @@ func dataProcessing(globCtx context.Context, globCancel context.CancelFunc, clie
 					var process [16]byte
 					copy(process[:], u.SupplyRequest.GetProcess())
 					mime := u.SupplyRequest.GetMime()
-					err := WriteUserData(&pubKey, &dataUUID, &mime, u.SupplyRequest.GetValue())
-					if err != nil {
+					var err error
+					if !IsDAGLeaf(&dataUUID) {
+						logrus.Printf("DataResponse_SupplyRequest %v is not a leaf", DataID(dataUUID))
+						err = pb.ErrNotAllowed
+					} else if err = store.WriteUserData(&pubKey, &dataUUID, &mime, u.SupplyRequest.GetValue(), spb.DataSource_SUPPLY, process[:]); err != nil {
 						logrus.Println("DataResponse_SupplyRequest err", err)
-						continue
+					} else {
+						logrus.Printf("User %s, %v written, mime %s", common.B2S(pubKey[:]), DataID(dataUUID), mime)
+					}
+					ok := reply(&pb.DataRequest{
+						Request: &pb.DataRequest_SupplyResponse{
+							SupplyResponse: &pb.DataSupplyResponse{
+								PublicKey: pubKey[:],
+								Data:      dataUUID[:],
+								Process:   process[:],
+								Error:     pb.CodeFromError(err),
+							},
+						},
+					})
+					if !ok {
+						return
 					}
-					logrus.Printf("User %s, uuid %s  written, mime %s", common.B2S(pubKey[:]), common.Bytes2uuid(dataUUID[:]), mime)
-
 				}
 			case *pb.DataResponse_DeleteRequest:
 				{
-					// TODO: delete from db
+					var pubKey [32]byte
+					copy(pubKey[:], u.DeleteRequest.GetPublicKey())
+					var dataUUID [16]byte
+					copy(dataUUID[:], u.DeleteRequest.GetData())
+					err := store.DeleteUserData(&pubKey, &dataUUID)
+					switch {
+					case err == nil:
+						logrus.Printf("User %s, %v deleted", common.B2S(pubKey[:]), DataID(dataUUID))
+					case !errors.Is(err, pb.ErrNotFound):
+						logrus.Println("DataResponse_DeleteRequest err", err)
+					}
 					msg := &pb.DataRequest{
 						Request: &pb.DataRequest_DeleteResponse{
 							DeleteResponse: &pb.DataDeleteResponse{
 								PublicKey: u.DeleteRequest.GetPublicKey(),
 								Data:      u.DeleteRequest.GetData(),
-								Error:     0,
+								Process:   u.DeleteRequest.GetProcess(),
+								Error:     pb.CodeFromError(err),
 							},
 						},
 					}
-					stream.Send(msg)
+					if !reply(msg) {
+						return
+					}
 				}
 			}
 
 		}
 	}()
 
-	go func() {
-		for {
-			select {
-			case r := <-dataReq:
-				var key [48]byte
-				copy(key[:], r.Request.RetrieveRequest.PublicKey)
-				copy(key[32:], r.Request.RetrieveRequest.Data)
-				respChan[key] = r.Response
-				stream.Send(&pb.DataRequest{
-					Request: r.Request,
-				})
-			case <-waitChanel:
-				return
+	defer stream.CloseSend()
+	for {
+		select {
+		case r := <-retrievals.queue:
+			err := send(&pb.DataRequest{
+				Request: r.Request,
+			})
+			if err != nil {
+				retrievals.Resolve(r.key, nil, err)
 			}
+		case <-waitChanel:
+			return
 		}
-	}()
-
-	<-waitChanel
-	stream.CloseSend()
-
+	}
 }
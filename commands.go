@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// command of the CLI, run gets the arguments after the command name
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(args []string)
+}
+
+// commands in the order of the usage text, set in init as help refers to them
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "", "Run the web server and the proxyU client, the default command", serveCmd},
+		{"validate-dag", "[file...]", "Check didgraph files", validateDAGCmd},
+		{"db inspect", "", "Count the records of the storage", dbInspectCmd},
+		{"db compact", "", "Rewrite the bolt file without free pages, with the server stopped", dbCompactCmd},
+		{"rotate-keys", "", "Re-encrypt the bolt storage with the first master key", rotateKeysCmd},
+		{"import", "[flags] <file.csv|file.json>", "Bulk load user data", importCmd},
+		{"export-subject", "<base64 public key> [file.json|file.zip]", "Export all data of a data subject", exportSubjectCmd},
+		{"correlate", "", "Identify a data subject with a QR code in the terminal", correlateCmd},
+		{"request-permission", "[flags] <base64 public key> <data>", "Request a permission of a data subject with a QR code in the terminal", requestPermissionCmd},
+		{"submit-document", "<https url>", "Submit the privacy policy to proxyU", submitDocumentCmd},
+		{"config show", "", "Print the effective config with secrets redacted", configShowCmd},
+		{"help", "", "Show this help", helpCmd},
+	}
+}
+
+// findCommand command named by the first arguments, nil if there is none
+func findCommand(args []string) (*command, []string) {
+	for i := range commands {
+		words := strings.Fields(commands[i].name)
+		if len(args) < len(words) {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == commands[i].name {
+			return &commands[i], args[len(words):]
+		}
+	}
+	return nil, args
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	cmd, cmdArgs := findCommand(args)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", strings.Join(args, " "))
+		usage()
+		os.Exit(2)
+	}
+	cmd.run(cmdArgs)
+}
+
+// newFlagSet flags of a command. The global flags are shared, so they are
+// accepted before and after the command name.
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [global flags] %s %s\n", programName(), name, args)
+		// Only the flags of the command, the global ones are listed by help
+		own := flag.NewFlagSet(name, flag.ContinueOnError)
+		own.SetOutput(fs.Output())
+		fs.VisitAll(func(f *flag.Flag) {
+			if flag.Lookup(f.Name) == nil {
+				own.Var(f.Value, f.Name, f.Usage)
+			}
+		})
+		own.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parse flags of a command and load the config, exits with usage
+// if the number of remaining arguments is outside of min..max, max < 0 is
+// unlimited
+func parseArgs(fs *flag.FlagSet, args []string, min, max int) []string {
+	fs.Parse(args)
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := loadConfig(fs); err != nil {
+		logrus.Fatalf("config: %v", err)
+	}
+	if err := validateConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return fs.Args()
+}
+
+func programName() string {
+	return filepath.Base(os.Args[0])
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s [global flags] [command] [args]\n\ncommands:\n", programName())
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-20s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintf(out, "\n%s help <command> shows the arguments of a command.\n\nglobal flags:\n", programName())
+	flag.PrintDefaults()
+}
+
+// helpCmd `help [command]`
+func helpCmd(args []string) {
+	if len(args) == 0 {
+		flag.CommandLine.SetOutput(os.Stdout)
+		usage()
+		return
+	}
+	cmd, _ := findCommand(args)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", strings.Join(args, " "))
+		os.Exit(2)
+	}
+	fmt.Println(cmd.usage)
+	// All commands parse their flags first, -h prints their usage and exits
+	cmd.run([]string{"-h"})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/language"
+	"gopkg.in/yaml.v3"
+)
+
+// configEnvPrefix of the environment variables of the settings, DATAU_TLS_KEY sets -tls-key
+const configEnvPrefix = "DATAU_"
+
+// Sources of a setting, later ones override earlier ones
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+var configFile = flag.String("config", "", "YAML file with settings named like the flags, "+configEnvPrefix+"CONFIG if empty")
+
+// configEnvNames variables which do not follow the flag names,
+// DATAU_MASTER_KEY holds the keys themselves
+var configEnvNames = map[string]string{
+	"master-key": masterKeyEnv + "_FILE",
+}
+
+// configSecrets settings redacted in the effective config
+var configSecrets = map[string]bool{
+	"session-hash-key":  true,
+	"session-block-key": true,
+	"admin-token":       true,
+}
+
+// configSources source of every setting once loadConfig is done
+var configSources = make(map[string]string)
+
+// configEnv environment variable of a setting
+func configEnv(name string) string {
+	if env, ok := configEnvNames[name]; ok {
+		return env
+	}
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadConfig fill the settings which are not given as flags from the config
+// file and then the environment. fs are the flags of the command.
+func loadConfig(fs *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	flag.VisitAll(func(f *flag.Flag) {
+		configSources[f.Name] = sourceDefault
+		if explicit[f.Name] {
+			configSources[f.Name] = sourceFlag
+		}
+	})
+
+	if env, ok := os.LookupEnv(configEnv("config")); ok && !explicit["config"] {
+		*configFile = env
+		configSources["config"] = sourceEnv
+	}
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			return err
+		}
+		for name, value := range values {
+			if explicit[name] {
+				continue
+			}
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("%s: %s %q: %v", *configFile, name, value, err)
+			}
+			configSources[name] = sourceFile
+		}
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(configEnv(f.Name))
+		if !ok || explicit[f.Name] || f.Name == "config" || err != nil {
+			return
+		}
+		if err = f.Value.Set(value); err != nil {
+			err = fmt.Errorf("%s %q: %v", configEnv(f.Name), value, err)
+			return
+		}
+		configSources[f.Name] = sourceEnv
+	})
+	return err
+}
+
+// readConfigFile settings of a YAML file, keys are flag names
+func readConfigFile(path string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var nodes map[string]yaml.Node
+	if err := yaml.Unmarshal(content, &nodes); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	values := make(map[string]string, len(nodes))
+	for name, node := range nodes {
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("%s: line %d: unknown setting %s", path, node.Line, name)
+		}
+		if node.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("%s: line %d: %s must be a single value", path, node.Line, name)
+		}
+		values[name] = node.Value
+	}
+	return values, nil
+}
+
+// validateConfig check settings together, all problems are reported at once
+func validateConfig() error {
+	var problems []string
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, a...))
+		}
+	}
+	switch *storageBackend {
+	case "bolt":
+		check(*userDataDB != "", "userdata must be set for the bolt storage")
+	case "sqlite":
+		check(*storageDSN != "", "storage-dsn must be set for the sqlite storage")
+	case "postgres", "memory":
+	default:
+		check(false, "storage %q is not bolt, postgres, sqlite or memory", *storageBackend)
+	}
+	if *masterKeyFile != "" {
+		_, err := os.Stat(*masterKeyFile)
+		check(err == nil, "master-key: %v", err)
+	}
+	_, err := uuid.Parse(*processUUID)
+	check(err == nil, "process %q is not a UUID", *processUUID)
+	_, err = language.Parse(*defaultLang)
+	check(err == nil, "lang %q is not a language tag", *defaultLang)
+	check(*serverPort > 0 && *serverPort < 65536, "port %d is outside of 1..65535", *serverPort)
+	check(*proxyuAddress != "", "proxyu must be set")
+	check(*dagReload >= 0, "dag-reload must not be negative")
+	check(*sessionMaxAge > 0, "session-max-age must be positive")
+	check(*sessionSweep >= 0, "session-sweep must not be negative")
+	check(*historyKeep >= 0, "history-retention must not be negative")
+	check(*adminToken == "" || len(*adminToken) >= 16, "admin-token must be at least 16 characters")
+	sessionKeys := []struct {
+		spec  sessionKeySpec
+		value string
+	}{
+		{hashKeySpec, *sessionHashKey},
+		{blockKeySpec, *sessionBlockKey},
+	}
+	for _, k := range sessionKeys {
+		if k.value != "" {
+			_, err := k.spec.decode(k.value)
+			check(err == nil, "%v", err)
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// configSetting one line of the effective config
+type configSetting struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+// effectiveConfig all settings with secrets redacted, ordered by name
+func effectiveConfig() (settings []configSetting) {
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch {
+		case configSecrets[f.Name] && value != "":
+			value = "<redacted>"
+		case f.Name == "storage-dsn":
+			value = redactDSN(value)
+		}
+		source := configSources[f.Name]
+		if source == "" {
+			source = sourceDefault
+		}
+		settings = append(settings, configSetting{Name: f.Name, Value: value, Source: source})
+	})
+	return
+}
+
+// dsnPassword password of a key=value connection string
+var dsnPassword = regexp.MustCompile(`(password=)('[^']*'|\S+)`)
+
+// redactDSN connection string without its password
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return dsnPassword.ReplaceAllString(dsn, "${1}xxxxx")
+}
+
+// logConfig report the effective config at startup
+func logConfig() {
+	for _, s := range effectiveConfig() {
+		logrus.Infof("config %s=%s (%s)", s.Name, s.Value, s.Source)
+	}
+}
+
+// configShowCmd `config show` print the effective config as a config file,
+// with the source of each setting as comment. Exit status 1 if it is invalid.
+func configShowCmd(args []string) {
+	fs := newFlagSet("config show", "")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := loadConfig(fs); err != nil {
+		logrus.Fatal(err)
+	}
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, s := range effectiveConfig() {
+		if s.Name == "config" {
+			doc.HeadComment = fmt.Sprintf("config: %s (%s)", s.Value, s.Source)
+			continue
+		}
+		doc.Content = append(doc.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: s.Name},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: s.Value, LineComment: s.Source})
+	}
+	enc := yaml.NewEncoder(os.Stdout)
+	if err := enc.Encode(doc); err != nil {
+		logrus.Fatal(err)
+	}
+	enc.Close()
+	if err := validateConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
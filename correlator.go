@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	pb "github.com/ice2heart/proxyu_client/protocol"
+)
+
+// dataRequest outbound retrieve request waiting for its response
+type dataRequest struct {
+	Request *pb.DataRequest_RetrieveRequest
+	key     [48]byte
+	done    chan struct{}
+	// send is closed when this waiter sends the request of its key
+	send chan struct{}
+	// Fields and Err are set before done is closed
+	Fields []*pb.DataField
+	Err    error
+}
+
+// pendingRetrieve waiters for one key, one request goes out for all of them
+type pendingRetrieve struct {
+	waiters []*dataRequest
+	// sender waiter which sends the request, nil if there is none yet
+	sender *dataRequest
+	// sent true once the request is on the stream
+	sent bool
+}
+
+// correlator match retrieve responses from the Data stream to the waiting requests.
+// Responses are keyed by public key and data, every waiter for the key gets the same answer.
+type correlator struct {
+	mu      sync.Mutex
+	waiters map[[48]byte]*pendingRetrieve
+	queue   chan *dataRequest
+}
+
+func newCorrelator() *correlator {
+	return &correlator{
+		waiters: make(map[[48]byte]*pendingRetrieve),
+		queue:   make(chan *dataRequest),
+	}
+}
+
+func correlationKey(pubKey, data []byte) (key [48]byte) {
+	copy(key[:32], pubKey)
+	copy(key[32:], data)
+	return
+}
+
+// Retrieve send request to the Data stream and wait for the response. Only
+// the first waiter for a key sends it, the others wait for the same response.
+// If the sender gives up before the request is out, the next waiter sends it.
+func (c *correlator) Retrieve(ctx context.Context, req *pb.DataRetrieveRequest) ([]*pb.DataField, error) {
+	r := &dataRequest{
+		Request: &pb.DataRequest_RetrieveRequest{RetrieveRequest: req},
+		key:     correlationKey(req.GetPublicKey(), req.GetData()),
+		done:    make(chan struct{}),
+		send:    make(chan struct{}),
+	}
+	c.add(r)
+	defer c.remove(r)
+
+	select {
+	case <-r.send:
+	case <-r.done:
+		return r.Fields, r.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case c.queue <- r:
+		c.markSent(r.key)
+	case <-r.done:
+		return r.Fields, r.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case <-r.done:
+		return r.Fields, r.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// add waiter, it becomes the sender if the key has none
+func (c *correlator) add(r *dataRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.waiters[r.key]
+	if !ok {
+		p = &pendingRetrieve{}
+		c.waiters[r.key] = p
+	}
+	p.waiters = append(p.waiters, r)
+	if p.sender == nil && !p.sent {
+		p.sender = r
+		close(r.send)
+	}
+}
+
+func (c *correlator) markSent(key [48]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Resolved already if it is gone
+	if p, ok := c.waiters[key]; ok {
+		p.sent = true
+	}
+}
+
+// remove waiter which is done or gave up, the next waiter takes over a
+// request which is not sent yet
+func (c *correlator) remove(r *dataRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.waiters[r.key]
+	if !ok {
+		return
+	}
+	for i, w := range p.waiters {
+		if w == r {
+			p.waiters = append(p.waiters[:i:i], p.waiters[i+1:]...)
+			break
+		}
+	}
+	if len(p.waiters) == 0 {
+		delete(c.waiters, r.key)
+		return
+	}
+	if p.sender == r && !p.sent {
+		p.sender = p.waiters[0]
+		close(p.sender.send)
+	}
+}
+
+// Resolve answer all waiters for the key, false if nobody is waiting
+func (c *correlator) Resolve(key [48]byte, fields []*pb.DataField, err error) bool {
+	c.mu.Lock()
+	p, ok := c.waiters[key]
+	delete(c.waiters, key)
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	for _, r := range p.waiters {
+		r.finish(fields, err)
+	}
+	return len(p.waiters) > 0
+}
+
+// FailAll answer every waiter with err, used when the stream dies
+func (c *correlator) FailAll(err error) {
+	c.mu.Lock()
+	waiters := c.waiters
+	c.waiters = make(map[[48]byte]*pendingRetrieve)
+	c.mu.Unlock()
+	for _, p := range waiters {
+		for _, r := range p.waiters {
+			r.finish(nil, err)
+		}
+	}
+}
+
+func (r *dataRequest) finish(fields []*pb.DataField, err error) {
+	r.Fields = fields
+	r.Err = err
+	close(r.done)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/ice2heart/proxyu_client/protocol"
+)
+
+func testRetrieveRequest(b byte) *pb.DataRetrieveRequest {
+	pubKey := make([]byte, 32)
+	data := make([]byte, 16)
+	pubKey[0], data[0] = b, b
+	return &pb.DataRetrieveRequest{PublicKey: pubKey, Data: data}
+}
+
+// waitWaiters block until n requests wait for the key
+func waitWaiters(t *testing.T, c *correlator, key [48]byte, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		got := 0
+		if p, ok := c.waiters[key]; ok {
+			got = len(p.waiters)
+		}
+		c.mu.Unlock()
+		if got == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d waiters did not show up", n)
+}
+
+// assertNoRequest fail if a request is sent to the stream
+func assertNoRequest(t *testing.T, c *correlator) {
+	t.Helper()
+	select {
+	case r := <-c.queue:
+		t.Fatalf("unexpected request for %x", r.key)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func assertNoWaiters(t *testing.T, c *correlator) {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.waiters) != 0 {
+		t.Fatalf("waiters left: %d", len(c.waiters))
+	}
+}
+
+func TestCorrelatorSeveralWaiters(t *testing.T) {
+	c := newCorrelator()
+	req := testRetrieveRequest(1)
+	key := correlationKey(req.PublicKey, req.Data)
+	fields := []*pb.DataField{{Mime: "text/plain", Value: []byte("Albert")}}
+
+	const n = 3
+	var wg sync.WaitGroup
+	results := make([][]*pb.DataField, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = c.Retrieve(context.Background(), req)
+		}(i)
+	}
+	// Only the first waiter sends, the others are answered with its response
+	<-c.queue
+	waitWaiters(t, c, key, n)
+	assertNoRequest(t, c)
+	if !c.Resolve(key, fields, nil) {
+		t.Fatal("Resolve found no waiter")
+	}
+	wg.Wait()
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Fatalf("waiter %d: %v", i, errs[i])
+		}
+		if len(results[i]) != 1 || string(results[i][0].Value) != "Albert" {
+			t.Fatalf("waiter %d got %v", i, results[i])
+		}
+	}
+	assertNoWaiters(t, c)
+	if c.Resolve(key, fields, nil) {
+		t.Fatal("second Resolve found waiters")
+	}
+}
+
+func TestCorrelatorErrorResponse(t *testing.T) {
+	c := newCorrelator()
+	req := testRetrieveRequest(2)
+	go func() {
+		r := <-c.queue
+		c.Resolve(r.key, nil, pb.ErrNotFound)
+	}()
+	_, err := c.Retrieve(context.Background(), req)
+	if !errors.Is(err, pb.ErrNotFound) {
+		t.Fatalf("got %v, want not found", err)
+	}
+	assertNoWaiters(t, c)
+}
+
+func TestCorrelatorCancelBeforeSend(t *testing.T) {
+	c := newCorrelator()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// Nobody reads the queue
+	_, err := c.Retrieve(ctx, testRetrieveRequest(3))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want canceled", err)
+	}
+	assertNoWaiters(t, c)
+}
+
+func TestCorrelatorSenderGivesUp(t *testing.T) {
+	c := newCorrelator()
+	req := testRetrieveRequest(6)
+	key := correlationKey(req.PublicKey, req.Data)
+	ctx, cancel := context.WithCancel(context.Background())
+	senderDone := make(chan error)
+	go func() {
+		_, err := c.Retrieve(ctx, req)
+		senderDone <- err
+	}()
+	waitWaiters(t, c, key, 1)
+	result := make(chan error)
+	go func() {
+		_, err := c.Retrieve(context.Background(), req)
+		result <- err
+	}()
+	waitWaiters(t, c, key, 2)
+	// Nobody read the request of the first waiter, the second one sends it
+	cancel()
+	if err := <-senderDone; !errors.Is(err, context.Canceled) {
+		t.Fatalf("sender got %v, want canceled", err)
+	}
+	r := <-c.queue
+	assertNoRequest(t, c)
+	c.Resolve(r.key, nil, nil)
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	assertNoWaiters(t, c)
+}
+
+func TestCorrelatorTimeoutAfterSend(t *testing.T) {
+	c := newCorrelator()
+	req := testRetrieveRequest(4)
+	go func() { <-c.queue }()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := c.Retrieve(ctx, req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+	assertNoWaiters(t, c)
+	// A late response finds nobody
+	if c.Resolve(correlationKey(req.PublicKey, req.Data), nil, nil) {
+		t.Fatal("late Resolve found a waiter")
+	}
+}
+
+func TestCorrelatorResolveRacesTimeout(t *testing.T) {
+	c := newCorrelator()
+	req := testRetrieveRequest(5)
+	fields := []*pb.DataField{{Value: []byte("x")}}
+	for i := 0; i < 200; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(i%5)*50*time.Microsecond)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			select {
+			case r := <-c.queue:
+				c.Resolve(r.key, fields, nil)
+			case <-ctx.Done():
+			}
+		}()
+		got, err := c.Retrieve(ctx, req)
+		switch {
+		case err == nil:
+			if len(got) != 1 {
+				t.Fatalf("round %d: got %v", i, got)
+			}
+		case !errors.Is(err, context.DeadlineExceeded):
+			t.Fatalf("round %d: %v", i, err)
+		}
+		<-done
+		cancel()
+		assertNoWaiters(t, c)
+	}
+}
+
+func TestCorrelatorFailAll(t *testing.T) {
+	c := newCorrelator()
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = c.Retrieve(context.Background(), testRetrieveRequest(byte(10+i)))
+		}(i)
+	}
+	<-c.queue
+	<-c.queue
+	c.FailAll(errDataStreamClosed)
+	wg.Wait()
+	for i, err := range errs {
+		if !errors.Is(err, errDataStreamClosed) {
+			t.Fatalf("waiter %d: got %v", i, err)
+		}
+	}
+	assertNoWaiters(t, c)
+}
@@ -1,74 +1,213 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/ice2heart/proxyu_client/common"
+	"github.com/google/uuid"
+	"github.com/ice2heart/proxyu_client/dag"
+	"github.com/ice2heart/proxyu_client/l10n"
+	"github.com/sirupsen/logrus"
 
 	"gopkg.in/yaml.v2"
 )
 
+// DAGNode entry of the didgraph
+type DAGNode struct {
+	Key         string
+	Mime        string
+	Description string
+	Children    []string `yaml:",flow"`
+}
+
 // DAGYAML struct for parsing
 type DAGYAML struct {
-	Didgraph []struct {
-		Key         string
-		Mime        string
-		Description string
-		Children    []string `yaml:",flow"`
-	} `yaml:",flow"`
+	Didgraph []DAGNode `yaml:",flow"`
+}
+
+// dagState didgraph with its names, replaced as a whole on reload
+type dagState struct {
+	Version  uint64
+	YAML     DAGYAML
+	Graph    *dag.Graph
+	DevNames map[string][]byte
+	DevIDs   map[DataID]string
+	L10n     *l10n.Catalog
 }
 
 var (
-	daggraph DAGYAML
-	graph    map[[16]byte][][16]byte
+	dagCurrent  atomic.Value // *dagState
+	dagReloadMu sync.Mutex
+	emptyDAG    = &dagState{Graph: dag.New()}
 )
 
-// ParseDAGYML tree
-func ParseDAGYML(path *string) {
-	data, err := ioutil.ReadFile(*path)
-	if err != nil {
-		log.Panic(err)
+// currentDAG graph in use, never nil
+func currentDAG() *dagState {
+	if state, ok := dagCurrent.Load().(*dagState); ok {
+		return state
 	}
-	daggraph = DAGYAML{}
-	err = yaml.Unmarshal([]byte(data), &daggraph)
+	return emptyDAG
+}
+
+// ParseDAGYML load and validate tree, errors are *dag.LoadError for invalid files
+func ParseDAGYML(path *string) (DAGYAML, *dag.Graph, error) {
+	def, err := dag.Load(*path)
 	if err != nil {
-		log.Fatalf("error: %v", err)
-	}
-	graph = make(map[[16]byte][][16]byte)
-	for k := range daggraph.Didgraph {
-		var rawUUID [16]byte
-		copy(rawUUID[:], common.UUID2bytes(daggraph.Didgraph[k].Key))
-		for _, ch := range daggraph.Didgraph[k].Children {
-			var child [16]byte
-			copy(child[:], common.UUID2bytes(ch))
-			graph[rawUUID] = append(graph[rawUUID], child)
-		}
+		return DAGYAML{}, nil, err
 	}
+	parsed := DAGYAML{}
+	for _, node := range def.Nodes {
+		parsed.Didgraph = append(parsed.Didgraph, DAGNode{
+			Key:         node.Key,
+			Mime:        node.Mime,
+			Description: node.Description,
+			Children:    node.Children,
+		})
+	}
+	return parsed, def.Graph, nil
 }
 
 // ParseDAGDevYML prepare map for easy access
-func ParseDAGDevYML(path *string) (result map[string][]byte) {
+func ParseDAGDevYML(path *string) (map[string][]byte, error) {
 	data, err := ioutil.ReadFile(*path)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-	result = make(map[string][]byte)
+	result := make(map[string][]byte)
 	m := make(map[string]string)
 
 	err = yaml.Unmarshal([]byte(data), &m)
 	if err != nil {
-		log.Fatalf("error: %v", err)
+		return nil, fmt.Errorf("%s: %w", *path, err)
 	}
 	for k, v := range m {
-		result[strings.ToUpper(v)] = common.UUID2bytes(k)
+		id, err := uuid.Parse(k)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", *path, k, err)
+		}
+		result[strings.ToUpper(v)] = id[:]
 	}
-	return
+	return result, nil
+}
+
+// ReloadDAG parse and swap the graph files, the current graph is kept on error
+func ReloadDAG() error {
+	dagReloadMu.Lock()
+	defer dagReloadMu.Unlock()
+	parsed, graph, err := ParseDAGYML(dagyml)
+	if err != nil {
+		return err
+	}
+	devNames, err := ParseDAGDevYML(dagdevyml)
+	if err != nil {
+		return err
+	}
+	catalog, err := l10n.Load(*l10nDir, *defaultLang)
+	if err != nil {
+		return err
+	}
+	devIDs := make(map[DataID]string, len(devNames))
+	for name, raw := range devNames {
+		var id DataID
+		copy(id[:], raw)
+		devIDs[id] = strings.ToLower(name)
+	}
+	state := &dagState{
+		Version:  currentDAG().Version + 1,
+		YAML:     parsed,
+		Graph:    graph,
+		DevNames: devNames,
+		DevIDs:   devIDs,
+		L10n:     catalog,
+	}
+	dagCurrent.Store(state)
+	logrus.Infof("Didgraph version %d loaded", state.Version)
+	return nil
 }
 
-// GetDAGChildren return slice of children
-func GetDAGChildren(ID *[16]byte) (children [][16]byte) {
-	children = graph[*ID]
+// watchDAG reload the graph on SIGHUP or when the files change
+func watchDAG(ctx context.Context, interval time.Duration) {
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	modified := dagFilesModified()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hupCh:
+			logrus.Info("SIGHUP, reload didgraph")
+		case <-tick:
+			m := dagFilesModified()
+			if m.Equal(modified) {
+				continue
+			}
+			modified = m
+			logrus.Info("Didgraph files changed, reload")
+		}
+		if err := ReloadDAG(); err != nil {
+			logrus.Errorf("Didgraph reload failed, version %d is kept: %v", currentDAG().Version, err)
+		}
+	}
+}
+
+// dagFilesModified latest modification time of the graph files
+func dagFilesModified() (latest time.Time) {
+	paths, _ := filepath.Glob(filepath.Join(*l10nDir, "*.yml"))
+	for _, path := range append(paths, *dagyml, *dagdevyml) {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
 	return
 }
+
+// validateDAGCmd `validate-dag [file...]` check graph files, exit status 1 if any is invalid
+func validateDAGCmd(args []string) {
+	args = parseArgs(newFlagSet("validate-dag", "[file...]"), args, 0, -1)
+	if len(args) == 0 {
+		args = []string{*dagyml}
+	}
+	failed := false
+	for _, path := range args {
+		if _, err := dag.Load(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: ok\n", path)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// GetDAGLeaves return all leaves of the node, the leaf itself for a leaf
+func GetDAGLeaves(ID *[16]byte) ([][16]byte, error) {
+	return currentDAG().Graph.Leaves(*ID)
+}
+
+// IsDAGLeaf true if node is known and has no children
+func IsDAGLeaf(ID *[16]byte) bool {
+	return currentDAG().Graph.IsLeaf(*ID)
+}
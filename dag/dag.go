@@ -0,0 +1,180 @@
+// Package dag resolves nodes of the data identification graph
+package dag
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ID 16 bytes UUIDv4 of a node
+type ID = [16]byte
+
+// ErrUnknownNode node is not defined in the graph
+var ErrUnknownNode = errors.New("unknown node")
+
+// CycleError graph has a cycle, Path starts and ends with the same node
+type CycleError struct {
+	Path []ID
+}
+
+func (e *CycleError) Error() string {
+	path := make([]string, len(e.Path))
+	for i, id := range e.Path {
+		path[i] = uuid.UUID(id).String()
+	}
+	return "cycle in graph: " + strings.Join(path, " -> ")
+}
+
+// Graph nodes and their direct children
+type Graph struct {
+	nodes    map[ID]bool
+	children map[ID][]ID
+	// order nodes in the order they were added
+	order []ID
+}
+
+// New empty graph
+func New() *Graph {
+	return &Graph{
+		nodes:    make(map[ID]bool),
+		children: make(map[ID][]ID),
+	}
+}
+
+// AddNode define node
+func (g *Graph) AddNode(id ID) {
+	if !g.nodes[id] {
+		g.order = append(g.order, id)
+	}
+	g.nodes[id] = true
+}
+
+// AddChild link child to parent
+func (g *Graph) AddChild(parent, child ID) {
+	g.children[parent] = append(g.children[parent], child)
+}
+
+// Has true if node is defined
+func (g *Graph) Has(id ID) bool {
+	return g.nodes[id]
+}
+
+// Children direct children of the node
+func (g *Graph) Children(id ID) []ID {
+	return g.children[id]
+}
+
+// IsLeaf true if node is defined and has no children
+func (g *Graph) IsLeaf(id ID) bool {
+	return g.nodes[id] && len(g.children[id]) == 0
+}
+
+// Leaves all leaves reachable from the node in depth-first order, each leaf once.
+// A leaf resolves to itself.
+func (g *Graph) Leaves(id ID) ([]ID, error) {
+	if !g.nodes[id] {
+		return nil, fmt.Errorf("%w %s", ErrUnknownNode, uuid.UUID(id))
+	}
+	var leaves []ID
+	seen := make(map[ID]bool)
+	err := g.walk(id, nil, make(map[ID]bool), func(leaf ID) {
+		if !seen[leaf] {
+			seen[leaf] = true
+			leaves = append(leaves, leaf)
+		}
+	})
+	return leaves, err
+}
+
+// Validate every child is defined and there are no cycles, the first
+// problem in the order the nodes were added is returned
+func (g *Graph) Validate() error {
+	cycles, err := g.Cycles()
+	if err != nil {
+		return err
+	}
+	if len(cycles) > 0 {
+		return cycles[0]
+	}
+	return nil
+}
+
+// Cycles every cycle of the graph, one per edge closing it. Nodes and
+// children are walked in the order they were added, so the result is
+// stable. The error is ErrUnknownNode if a child is not defined.
+func (g *Graph) Cycles() (cycles []*CycleError, err error) {
+	state := make(map[ID]visitState)
+	for _, id := range g.order {
+		if err := g.visit(id, nil, state, &cycles); err != nil {
+			return nil, err
+		}
+	}
+	return cycles, nil
+}
+
+// visitState of a node during Cycles, nodes not in the map are unvisited
+type visitState int
+
+const (
+	visiting visitState = iota + 1
+	visited
+)
+
+// visit depth-first, nodes being visited are on path. Fully visited nodes
+// are not walked again.
+func (g *Graph) visit(id ID, path []ID, state map[ID]visitState, cycles *[]*CycleError) error {
+	if !g.nodes[id] {
+		return fmt.Errorf("%w %s", ErrUnknownNode, uuid.UUID(id))
+	}
+	path = append(path, id)
+	switch state[id] {
+	case visited:
+		return nil
+	case visiting:
+		start := 0
+		for path[start] != id {
+			start++
+		}
+		*cycles = append(*cycles, &CycleError{Path: append([]ID(nil), path[start:]...)})
+		return nil
+	}
+	state[id] = visiting
+	for _, child := range g.children[id] {
+		if err := g.visit(child, path, state, cycles); err != nil {
+			return err
+		}
+	}
+	state[id] = visited
+	return nil
+}
+
+// walk depth-first, path and onPath hold the nodes being visited
+func (g *Graph) walk(id ID, path []ID, onPath map[ID]bool, leaf func(ID)) error {
+	if !g.nodes[id] {
+		return fmt.Errorf("%w %s", ErrUnknownNode, uuid.UUID(id))
+	}
+	path = append(path, id)
+	if onPath[id] {
+		start := 0
+		for path[start] != id {
+			start++
+		}
+		return &CycleError{Path: append([]ID(nil), path[start:]...)}
+	}
+	children := g.children[id]
+	if len(children) == 0 {
+		leaf(id)
+		return nil
+	}
+	onPath[id] = true
+	defer delete(onPath, id)
+	for _, child := range children {
+		if err := g.walk(child, path, onPath, leaf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
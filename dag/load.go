@@ -0,0 +1,203 @@
+package dag
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// NodeMime MIME type of nodes which have children
+const NodeMime = "application/datau+node"
+
+// SupportedMimes MIME types allowed for the nodes of the graph
+var SupportedMimes = map[string]bool{
+	NodeMime:           true,
+	"text/plain":       true,
+	"application/json": true,
+	"application/pdf":  true,
+	"image/jpeg":       true,
+	"image/png":        true,
+}
+
+// Node entry of a didgraph file
+type Node struct {
+	ID          ID
+	Key         string
+	Mime        string
+	Description string
+	Children    []string
+	Line        int
+}
+
+// Definition loaded didgraph file
+type Definition struct {
+	Nodes []Node
+	Graph *Graph
+}
+
+// Issue problem found in a didgraph file
+type Issue struct {
+	Line int
+	Key  string
+	Msg  string
+}
+
+func (i Issue) String() string {
+	if i.Key == "" {
+		return fmt.Sprintf("line %d: %s", i.Line, i.Msg)
+	}
+	return fmt.Sprintf("line %d: %s: %s", i.Line, i.Key, i.Msg)
+}
+
+// LoadError all issues found in a didgraph file
+type LoadError struct {
+	File   string
+	Issues []Issue
+}
+
+func (e *LoadError) Error() string {
+	lines := make([]string, len(e.Issues))
+	for i, issue := range e.Issues {
+		lines[i] = e.File + ": " + issue.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+type fileYAML struct {
+	Didgraph []yaml.Node `yaml:"didgraph"`
+}
+
+type nodeYAML struct {
+	Key         yaml.Node   `yaml:"key"`
+	Mime        yaml.Node   `yaml:"mime"`
+	Description string      `yaml:"description"`
+	Children    []yaml.Node `yaml:"children"`
+}
+
+// Load read and validate didgraph file
+func Load(path string) (*Definition, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(path, data)
+}
+
+// Parse validate didgraph file content, errors are *LoadError
+func Parse(name string, data []byte) (*Definition, error) {
+	loadErr := &LoadError{File: name}
+	report := func(line int, key string, format string, args ...interface{}) {
+		loadErr.Issues = append(loadErr.Issues, Issue{Line: line, Key: key, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	var file fileYAML
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			for _, msg := range typeErr.Errors {
+				report(0, "", "%s", msg)
+			}
+			return nil, loadErr
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(file.Didgraph) == 0 {
+		report(1, "", "no didgraph entries")
+		return nil, loadErr
+	}
+
+	def := &Definition{Graph: New()}
+	lines := make(map[ID]int)
+	for _, entry := range file.Didgraph {
+		var n nodeYAML
+		if err := entry.Decode(&n); err != nil {
+			report(entry.Line, "", "%v", err)
+			continue
+		}
+		node := Node{Key: n.Key.Value, Mime: n.Mime.Value, Description: n.Description, Line: entry.Line}
+		keyLine := lineOf(&n.Key, entry.Line)
+		id, err := uuid.Parse(node.Key)
+		if err != nil {
+			report(keyLine, node.Key, "bad UUID: %v", err)
+			continue
+		}
+		node.ID = id
+		if first, ok := lines[node.ID]; ok {
+			report(keyLine, node.Key, "duplicate key, first defined at line %d", first)
+			continue
+		}
+		lines[node.ID] = keyLine
+
+		mimeLine := lineOf(&n.Mime, entry.Line)
+		mediaType, _, err := mime.ParseMediaType(node.Mime)
+		switch {
+		case node.Mime == "":
+			report(entry.Line, node.Key, "mime is missing")
+		case err != nil:
+			report(mimeLine, node.Key, "bad mime %q: %v", node.Mime, err)
+		case !SupportedMimes[mediaType]:
+			report(mimeLine, node.Key, "unsupported mime %q", node.Mime)
+		case len(n.Children) > 0 && mediaType != NodeMime:
+			report(mimeLine, node.Key, "has children but mime is %q, not %s", node.Mime, NodeMime)
+		}
+		for i := range n.Children {
+			node.Children = append(node.Children, n.Children[i].Value)
+		}
+		def.Nodes = append(def.Nodes, node)
+		def.Graph.AddNode(node.ID)
+	}
+
+	// Children may be defined after their parent
+	for _, entry := range file.Didgraph {
+		var n nodeYAML
+		if entry.Decode(&n) != nil {
+			continue
+		}
+		parent, err := uuid.Parse(n.Key.Value)
+		if err != nil || lines[parent] != lineOf(&n.Key, entry.Line) {
+			continue
+		}
+		for i := range n.Children {
+			child := &n.Children[i]
+			id, err := uuid.Parse(child.Value)
+			if err != nil {
+				report(child.Line, n.Key.Value, "bad child UUID %q: %v", child.Value, err)
+				continue
+			}
+			if !def.Graph.Has(id) {
+				report(child.Line, n.Key.Value, "unknown child %s", child.Value)
+				continue
+			}
+			def.Graph.AddChild(parent, id)
+		}
+	}
+
+	cycles, err := def.Graph.Cycles()
+	if err != nil {
+		report(0, "", "%v", err)
+	}
+	for _, cycle := range cycles {
+		report(lines[cycle.Path[0]], uuid.UUID(cycle.Path[0]).String(), "%v", cycle)
+	}
+	if len(loadErr.Issues) > 0 {
+		sort.SliceStable(loadErr.Issues, func(i, j int) bool {
+			return loadErr.Issues[i].Line < loadErr.Issues[j].Line
+		})
+		return nil, loadErr
+	}
+	return def, nil
+}
+
+// lineOf line of a decoded value, fallback if the field is absent
+func lineOf(n *yaml.Node, fallback int) int {
+	if n.Line == 0 {
+		return fallback
+	}
+	return n.Line
+}
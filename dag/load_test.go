@@ -0,0 +1,153 @@
+package dag
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const (
+	testRoot  = "00000000-0000-4000-8000-000000000001"
+	testChild = "00000000-0000-4000-8000-000000000002"
+	testOther = "00000000-0000-4000-8000-000000000003"
+	testLast  = "00000000-0000-4000-8000-000000000004"
+)
+
+// parseIssues issues of a file which must not load
+func parseIssues(t *testing.T, content string) []Issue {
+	t.Helper()
+	def, err := Parse("test.yml", []byte(content))
+	if err == nil {
+		t.Fatalf("file was accepted with %d nodes", len(def.Nodes))
+	}
+	var loadErr *LoadError
+	if !errors.As(err, &loadErr) {
+		t.Fatalf("got %T %v, want *LoadError", err, err)
+	}
+	return loadErr.Issues
+}
+
+// assertIssues issues are reported at the lines and contain the messages, in order
+func assertIssues(t *testing.T, got []Issue, want []Issue) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d issues %v, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		if got[i].Line != want[i].Line || got[i].Key != want[i].Key || !strings.Contains(got[i].Msg, want[i].Msg) {
+			t.Errorf("issue %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	def, err := Parse("test.yml", []byte(`didgraph:
+  - key: `+testRoot+`
+    mime: application/datau+node
+    children: [`+testChild+`]
+  - key: `+testChild+`
+    mime: text/plain
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(def.Nodes) != 2 || def.Nodes[0].Line != 2 || def.Nodes[1].Line != 5 {
+		t.Fatalf("nodes %+v", def.Nodes)
+	}
+	leaves, err := def.Graph.Leaves(def.Nodes[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaves) != 1 || leaves[0] != def.Nodes[1].ID {
+		t.Fatalf("leaves %v", leaves)
+	}
+}
+
+func TestParseDuplicateKey(t *testing.T) {
+	issues := parseIssues(t, `didgraph:
+  - key: `+testRoot+`
+    mime: text/plain
+  - key: `+testRoot+`
+    mime: text/plain
+`)
+	assertIssues(t, issues, []Issue{
+		{Line: 4, Key: testRoot, Msg: "duplicate key, first defined at line 2"},
+	})
+}
+
+func TestParseBadUUID(t *testing.T) {
+	issues := parseIssues(t, `didgraph:
+  - key: `+testRoot+`
+    mime: application/datau+node
+    children:
+      - not-a-uuid
+  - key: surname
+    mime: text/plain
+`)
+	assertIssues(t, issues, []Issue{
+		{Line: 5, Key: testRoot, Msg: `bad child UUID "not-a-uuid"`},
+		{Line: 6, Key: "surname", Msg: "bad UUID"},
+	})
+}
+
+func TestParseUnknownChild(t *testing.T) {
+	issues := parseIssues(t, `didgraph:
+  - key: `+testRoot+`
+    mime: application/datau+node
+    children:
+      - `+testChild+`
+      - `+testOther+`
+  - key: `+testChild+`
+    mime: text/plain
+`)
+	assertIssues(t, issues, []Issue{
+		{Line: 6, Key: testRoot, Msg: "unknown child " + testOther},
+	})
+}
+
+func TestParseMime(t *testing.T) {
+	issues := parseIssues(t, `didgraph:
+  - key: `+testRoot+`
+    mime: text/plain
+    children: [`+testChild+`]
+  - key: `+testChild+`
+    mime: video/mp4
+  - key: `+testOther+`
+`)
+	assertIssues(t, issues, []Issue{
+		{Line: 3, Key: testRoot, Msg: "has children but mime is"},
+		{Line: 6, Key: testChild, Msg: `unsupported mime "video/mp4"`},
+		{Line: 7, Key: testOther, Msg: "mime is missing"},
+	})
+}
+
+func TestParseCycles(t *testing.T) {
+	content := `didgraph:
+  - key: ` + testRoot + `
+    mime: application/datau+node
+    children: [` + testChild + `]
+  - key: ` + testChild + `
+    mime: application/datau+node
+    children: [` + testRoot + `]
+  - key: ` + testOther + `
+    mime: application/datau+node
+    children: [` + testLast + `]
+  - key: ` + testLast + `
+    mime: application/datau+node
+    children: [` + testOther + `]
+`
+	want := []Issue{
+		{Line: 2, Key: testRoot, Msg: "cycle in graph: " + testRoot + " -> " + testChild + " -> " + testRoot},
+		{Line: 8, Key: testOther, Msg: "cycle in graph: " + testOther + " -> " + testLast + " -> " + testOther},
+	}
+	// The nodes are kept in a map, the report must not depend on its order
+	for i := 0; i < 20; i++ {
+		assertIssues(t, parseIssues(t, content), want)
+	}
+}
+
+func TestParseEmpty(t *testing.T) {
+	assertIssues(t, parseIssues(t, "didgraph: []\n"), []Issue{
+		{Line: 1, Msg: "no didgraph entries"},
+	})
+}
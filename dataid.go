@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// DataID UUID of a data item in the didgraph
+type DataID [16]byte
+
+// ErrUnknownDataName name is not in the dev names file
+var ErrUnknownDataName = errors.New("unknown data name")
+
+// ParseDataID accept UUID or dev name such as last_name
+func ParseDataID(s string) (id DataID, err error) {
+	if u, err := uuid.Parse(s); err == nil {
+		return DataID(u), nil
+	}
+	err = id.FromName(s)
+	return
+}
+
+// FromName set id from dev name, case insensitive
+func (id *DataID) FromName(name string) error {
+	raw, ok := currentDAG().DevNames[strings.ToUpper(name)]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownDataName, name)
+	}
+	copy(id[:], raw)
+	return nil
+}
+
+// dataIDOf id from 16 bytes of a message
+func dataIDOf(b []byte) (id DataID) {
+	copy(id[:], b)
+	return
+}
+
+// Name dev name, empty if there is none
+func (id DataID) Name() string {
+	return currentDAG().DevIDs[id]
+}
+
+// UUID canonical string form
+func (id DataID) UUID() string {
+	return uuid.UUID(id).String()
+}
+
+// String dev name with UUID for logging
+func (id DataID) String() string {
+	if name := id.Name(); name != "" {
+		return fmt.Sprintf("%s (%s)", name, id.UUID())
+	}
+	return id.UUID()
+}
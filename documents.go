@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/ice2heart/proxyu_client/common"
+	pb "github.com/ice2heart/proxyu_client/protocol"
+	spb "github.com/ice2heart/proxyu_client/serialize"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	// documentFetchTimeout limit for downloading a document before submit
+	documentFetchTimeout = 30 * time.Second
+	// maxDocumentSize larger documents are rejected
+	maxDocumentSize = 10 << 20
+)
+
+// errNoPolicy no document was accepted by proxyU yet
+var errNoPolicy = errors.New("no policy document is registered")
+
+// errDocumentAddress document host resolves to an address of the local network
+var errDocumentAddress = errors.New("document host is not a public address")
+
+// nonPublicNets networks documents are never fetched from, the server must not
+// be used to reach services which are not public
+var nonPublicNets = parseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+func parseCIDRs(cidrs ...string) (nets []*net.IPNet) {
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDocumentURL https url of a host allowed by -document-hosts
+func checkDocumentURL(u *url.URL) error {
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("document url must start with https://: %s", u)
+	}
+	if *documentHosts == "" {
+		return nil
+	}
+	for _, host := range strings.Split(*documentHosts, ",") {
+		if strings.EqualFold(strings.TrimSpace(host), u.Hostname()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("document host %s is not in -document-hosts", u.Hostname())
+}
+
+// documentClient checks every redirect and connects to public addresses only.
+// It does not use a proxy, the address check would see the proxy instead of the host.
+var documentClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: documentFetchTimeout,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return fmt.Errorf("%w: %s", errDocumentAddress, host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		return checkDocumentURL(req.URL)
+	},
+}
+
+// SubmitDocument download the document, submit its hash to proxyU and store the result
+func SubmitDocument(ctx context.Context, store Store, client pb.ProxyUIntegrationClient, rawURL string) (*spb.Document, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("document url: %w", err)
+	}
+	if err := checkDocumentURL(u); err != nil {
+		return nil, err
+	}
+	docURL := u.String()
+	hash, err := fetchDocumentHash(ctx, docURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.SubmitDocument(ctx, &pb.SubmitDocumentRequest{Url: docURL, Hash: hash})
+	if err != nil {
+		return nil, fmt.Errorf("submit document: %w", err)
+	}
+	doc := &spb.Document{
+		Url:       docURL,
+		Hash:      hash,
+		Submitted: time.Now().Unix(),
+		Ok:        resp.GetOk(),
+		Error:     resp.GetError(),
+	}
+	if err := store.WriteDocument(doc); err != nil {
+		return nil, err
+	}
+	logrus.Printf("Document %s version %d submitted, ok %v %s", docURL, doc.Version, doc.Ok, doc.Error)
+	return doc, nil
+}
+
+func fetchDocumentHash(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, documentFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := documentClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch document: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch document: %s", resp.Status)
+	}
+	hash := sha3.New256()
+	n, err := io.Copy(hash, io.LimitReader(resp.Body, maxDocumentSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetch document: %w", err)
+	}
+	if n > maxDocumentSize {
+		return nil, fmt.Errorf("fetch document: larger than %d bytes", maxDocumentSize)
+	}
+	return hash.Sum(nil), nil
+}
+
+// CurrentPolicyHash hash of the latest accepted document
+func CurrentPolicyHash(store Store) ([]byte, error) {
+	doc := store.GetCurrentDocument()
+	if doc == nil {
+		return nil, errNoPolicy
+	}
+	return doc.GetHash(), nil
+}
+
+type documentsMessage struct {
+	Current   *spb.Document   `json:"current"`
+	Documents []*spb.Document `json:"documents"`
+}
+
+type submitDocumentMessage struct {
+	URL string `json:"url"`
+}
+
+func makeGetDocuments(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		docs, err := store.GetDocuments()
+		if err != nil {
+			logrus.Error(err)
+			httpError(w, r, http.StatusInternalServerError, "error.internal", err)
+			return
+		}
+		render.JSON(w, r, documentsMessage{Current: store.GetCurrentDocument(), Documents: docs})
+	}
+}
+
+func makePostDocument(store Store, client pb.ProxyUIntegrationClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var msg submitDocumentMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			httpError(w, r, http.StatusBadRequest, "error.bad_request", err)
+			return
+		}
+		u, err := url.Parse(msg.URL)
+		if err == nil {
+			err = checkDocumentURL(u)
+		}
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, "error.bad_request", err)
+			return
+		}
+		doc, err := SubmitDocument(r.Context(), store, client, msg.URL)
+		if err != nil {
+			logrus.Error(err)
+			httpError(w, r, http.StatusBadGateway, "error.document_submit", err)
+			return
+		}
+		if !doc.GetOk() {
+			render.Status(r, http.StatusUnprocessableEntity)
+		} else {
+			render.Status(r, http.StatusCreated)
+		}
+		render.JSON(w, r, doc)
+	}
+}
+
+// submitDocumentCmd `submit-document <url>` without starting the web server
+func submitDocumentCmd(args []string) {
+	args = parseArgs(newFlagSet("submit-document", "<https url>"), args, 1, 1)
+	store, err := openStore()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer store.Close()
+	conn, err := dialProxyU()
+	if err != nil {
+		logrus.Fatalf("did not connect: %v", err)
+	}
+	defer conn.Close()
+
+	doc, err := SubmitDocument(context.Background(), store, pb.NewProxyUIntegrationClient(conn), args[0])
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	fmt.Printf("version: %d\nurl: %s\nhash: %s\nok: %v\n", doc.Version, doc.Url, common.B2S(doc.Hash), doc.Ok)
+	if doc.Error != "" {
+		fmt.Printf("error: %s\n", doc.Error)
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/ice2heart/proxyu_client/common"
+	"github.com/ice2heart/proxyu_client/l10n"
+	"github.com/sirupsen/logrus"
+)
+
+// exportSchemaID $id of exportSchema, the $schema of every export
+const exportSchemaID = "urn:datau:subject-export:1"
+
+// subjectExport everything stored about a data subject
+type subjectExport struct {
+	Schema      string               `json:"$schema"`
+	Subject     string               `json:"subject"`
+	Exported    int64                `json:"exported"`
+	Language    string               `json:"language,omitempty"`
+	Data        []exportedData       `json:"data"`
+	Permissions []exportedPermission `json:"permissions"`
+	Sessions    []exportedSession    `json:"sessions"`
+}
+
+type exportedData struct {
+	ID    string `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Label string `json:"label,omitempty"`
+	exportedValue
+	History []exportedValue `json:"history,omitempty"`
+}
+
+type exportedValue struct {
+	Mime     string          `json:"mime"`
+	Encoding string          `json:"encoding"`
+	Value    json.RawMessage `json:"value"`
+	// File name of the raw value in a ZIP export
+	File    string `json:"file,omitempty"`
+	Version uint32 `json:"version"`
+	Written int64  `json:"written,omitempty"`
+	Source  string `json:"source"`
+	Process string `json:"process,omitempty"`
+
+	raw []byte
+}
+
+type exportedPermission struct {
+	Data      string `json:"data"`
+	Name      string `json:"name,omitempty"`
+	Label     string `json:"label,omitempty"`
+	Process   string `json:"process,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Policy    string `json:"policy,omitempty"`
+	From      uint64 `json:"from"`
+	Until     uint64 `json:"until"`
+	Amount    uint32 `json:"amount"`
+	Remaining uint32 `json:"remaining"`
+	Granted   int64  `json:"granted"`
+	Status    string `json:"status"`
+}
+
+type exportedSession struct {
+	Expires int64 `json:"expires"`
+	Active  bool  `json:"active"`
+}
+
+// exportedStatus status of a permission which can not be used, by permissionStatus
+var exportedStatus = map[int32]string{
+	statusNotYetValid: "not_yet_valid",
+	statusExpired:     "expired",
+	statusExhausted:   "exhausted",
+}
+
+// ExportSubject collect data with history, permissions and sessions of the subject.
+// Labels are taken from t, the didgraph description if it has none.
+func ExportSubject(store Store, pubKey *[32]byte, t *l10n.Translation, now time.Time) (*subjectExport, error) {
+	exp := &subjectExport{
+		Schema:      exportSchemaID,
+		Subject:     common.B2S(pubKey[:]),
+		Exported:    now.Unix(),
+		Data:        []exportedData{},
+		Permissions: []exportedPermission{},
+		Sessions:    []exportedSession{},
+	}
+	if t != nil {
+		exp.Language = t.Tag.String()
+	}
+	labels := exportLabels(t)
+
+	records, err := store.GetAllUserData(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("user data: %w", err)
+	}
+	perms, err := store.GetAllPermissions(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("permissions: %w", err)
+	}
+	// Retrieved versions of ended permissions may not be erased yet
+	kept := retrievedKept(perms, now)
+	for _, record := range records {
+		id := DataID(record.Data)
+		item := exportedData{
+			ID:            id.UUID(),
+			Name:          id.Name(),
+			Label:         labels[record.Data],
+			exportedValue: exportValue(record),
+		}
+		versions, err := store.GetUserDataHistory(pubKey, &record.Data)
+		if err != nil {
+			return nil, fmt.Errorf("history of %v: %w", id, err)
+		}
+		for _, v := range withoutLapsed(versions, kept) {
+			if v.Version != record.Version {
+				item.History = append(item.History, exportValue(v))
+			}
+		}
+		exp.Data = append(exp.Data, item)
+	}
+
+	for _, perm := range perms {
+		id := dataIDOf(perm.GetData())
+		p := exportedPermission{
+			Data:      id.UUID(),
+			Name:      id.Name(),
+			Label:     labels[id],
+			Process:   uuidString(perm.GetProcess()),
+			Reason:    uuidString(perm.GetReason()),
+			Policy:    common.B2S(perm.GetPolicy()),
+			From:      perm.GetFrom(),
+			Until:     perm.GetUntil(),
+			Amount:    perm.GetAmount(),
+			Remaining: perm.GetRemaining(),
+			Granted:   perm.GetGranted(),
+			Status:    "valid",
+		}
+		if err := CheckPermission(perm, now); err != nil {
+			p.Status = exportedStatus[permissionStatus(err)]
+		}
+		exp.Permissions = append(exp.Permissions, p)
+	}
+
+	sessions, err := store.GetSessions(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("sessions: %w", err)
+	}
+	for _, s := range sessions {
+		exp.Sessions = append(exp.Sessions, exportedSession{Expires: s.GetExpires(), Active: !sessionExpired(s, now)})
+	}
+	return exp, nil
+}
+
+// exportLabels translated label of every didgraph node
+func exportLabels(t *l10n.Translation) map[DataID]string {
+	labels := make(map[DataID]string)
+	for _, node := range currentDAG().YAML.Didgraph {
+		u, err := uuid.Parse(node.Key)
+		if err != nil {
+			continue
+		}
+		labels[DataID(u)] = node.Description
+		if label, ok := t.Label(u); ok {
+			labels[DataID(u)] = label
+		}
+	}
+	return labels
+}
+
+// exportValue decode value by MIME type: text as string, JSON as is, anything else base64
+func exportValue(record UserData) exportedValue {
+	v := exportedValue{
+		Mime:    record.Mime,
+		Version: record.Version,
+		Written: record.Written,
+		Source:  strings.ToLower(record.Source.String()),
+		Process: uuidString(record.Process),
+		raw:     record.Value,
+	}
+	mediaType, _, _ := mime.ParseMediaType(record.Mime)
+	switch {
+	case strings.HasPrefix(mediaType, "text/") && utf8.Valid(record.Value):
+		v.Encoding = "text"
+		v.Value, _ = json.Marshal(string(record.Value))
+	case mediaType == "application/json" && json.Valid(record.Value):
+		v.Encoding = "json"
+		v.Value = json.RawMessage(record.Value)
+	default:
+		v.Encoding = "base64"
+		v.Value, _ = json.Marshal(record.Value)
+	}
+	return v
+}
+
+// uuidString UUID of 16 bytes, empty otherwise
+func uuidString(b []byte) string {
+	if len(b) != 16 {
+		return ""
+	}
+	return dataIDOf(b).UUID()
+}
+
+// writeExportZIP export.json, schema.json and the raw value of every version under data/
+func writeExportZIP(w io.Writer, exp *subjectExport) error {
+	z := zip.NewWriter(w)
+	for i := range exp.Data {
+		item := &exp.Data[i]
+		values := []*exportedValue{&item.exportedValue}
+		for j := range item.History {
+			values = append(values, &item.History[j])
+		}
+		for _, v := range values {
+			v.File = fmt.Sprintf("data/%s.v%d%s", item.ID, v.Version, mimeExtension(v.Mime))
+			f, err := z.Create(v.File)
+			if err != nil {
+				return err
+			}
+			if _, err := f.Write(v.raw); err != nil {
+				return err
+			}
+		}
+	}
+	f, err := z.Create("export.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(exp); err != nil {
+		return err
+	}
+	if f, err = z.Create("schema.json"); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, exportSchema); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+func mimeExtension(mimeType string) string {
+	mediaType, _, _ := mime.ParseMediaType(mimeType)
+	switch mediaType {
+	case "text/plain":
+		return ".txt"
+	case "application/json":
+		return ".json"
+	case "application/pdf":
+		return ".pdf"
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	}
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// makeGetExport export of the logged in subject, ?format=zip for a ZIP bundle
+func makeGetExport(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := requestTranslation(r)
+		exp, err := ExportSubject(store, sessionFrom(r.Context()).PubKey, t, time.Now())
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, "error.internal", err)
+			return
+		}
+		if t != nil {
+			w.Header().Set("Content-Language", t.Tag.String())
+		}
+		name := "datau-export-" + time.Unix(exp.Exported, 0).UTC().Format("20060102-150405")
+		switch r.URL.Query().Get("format") {
+		case "", "json":
+			w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.json"`)
+			render.JSON(w, r, exp)
+		case "zip":
+			w.Header().Set("Content-Type", "application/zip")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.zip"`)
+			if err := writeExportZIP(w, exp); err != nil {
+				logrus.Errorf("Export failed: %v", err)
+			}
+		default:
+			httpError(w, r, http.StatusBadRequest, "error.bad_request", fmt.Errorf("unknown format %q", r.URL.Query().Get("format")))
+		}
+	}
+}
+
+// getExportSchema JSON schema of the exports
+func getExportSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	io.WriteString(w, exportSchema)
+}
+
+// exportSubjectCmd `export-subject <pubkey> [file.json|file.zip]`, stdout if no file is given
+func exportSubjectCmd(args []string) {
+	args = parseArgs(newFlagSet("export-subject", "<base64 public key> [file.json|file.zip]"), args, 1, 2)
+	key := common.S2B(args[0])
+	if len(key) != 32 {
+		logrus.Fatal("public key must be 32 bytes in base64")
+	}
+	var pubKey [32]byte
+	copy(pubKey[:], key)
+	// Labels and dev names come from the didgraph
+	if err := ReloadDAG(); err != nil {
+		logrus.Fatal(err)
+	}
+	store, err := openStore()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer store.Close()
+	exp, err := ExportSubject(store, &pubKey, currentDAG().L10n.Match(*defaultLang, ""), time.Now())
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	out := os.Stdout
+	if len(args) == 2 {
+		if out, err = os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			logrus.Fatal(err)
+		}
+		defer out.Close()
+	}
+	if len(args) == 2 && strings.EqualFold(filepath.Ext(args[1]), ".zip") {
+		err = writeExportZIP(out, exp)
+	} else {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(exp)
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// exportSchema JSON schema of subjectExport
+const exportSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "` + exportSchemaID + `",
+  "title": "Data subject export",
+  "type": "object",
+  "required": ["$schema", "subject", "exported", "data", "permissions", "sessions"],
+  "definitions": {
+    "uuid": {"type": "string", "pattern": "^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$"},
+    "timestamp": {"type": "integer", "description": "Unix UTC timestamp"},
+    "value": {
+      "type": "object",
+      "required": ["mime", "encoding", "value", "version", "source"],
+      "properties": {
+        "mime": {"type": "string"},
+        "encoding": {
+          "enum": ["text", "json", "base64"],
+          "description": "text: value is a string, json: value is the JSON document, base64: value is the base64 of the bytes"
+        },
+        "value": {},
+        "file": {"type": "string", "description": "Raw value in a ZIP export"},
+        "version": {"type": "integer", "description": "0 if written before versioning"},
+        "written": {"$ref": "#/definitions/timestamp"},
+        "source": {"enum": ["local", "supply", "retrieve"]},
+        "process": {"$ref": "#/definitions/uuid"}
+      }
+    }
+  },
+  "properties": {
+    "$schema": {"const": "` + exportSchemaID + `"},
+    "subject": {"type": "string", "description": "Base64 ed25519 public key"},
+    "exported": {"$ref": "#/definitions/timestamp"},
+    "language": {"type": "string", "description": "BCP 47 tag of the labels"},
+    "data": {
+      "type": "array",
+      "items": {
+        "allOf": [{"$ref": "#/definitions/value"}],
+        "required": ["id"],
+        "properties": {
+          "id": {"$ref": "#/definitions/uuid"},
+          "name": {"type": "string"},
+          "label": {"type": "string"},
+          "history": {"type": "array", "items": {"$ref": "#/definitions/value"}}
+        }
+      }
+    },
+    "permissions": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["data", "from", "until", "amount", "remaining", "granted", "status"],
+        "properties": {
+          "data": {"$ref": "#/definitions/uuid"},
+          "name": {"type": "string"},
+          "label": {"type": "string"},
+          "process": {"$ref": "#/definitions/uuid"},
+          "reason": {"$ref": "#/definitions/uuid"},
+          "policy": {"type": "string", "description": "Base64 SHA3-256 hash of the policy document"},
+          "from": {"$ref": "#/definitions/timestamp"},
+          "until": {"$ref": "#/definitions/timestamp"},
+          "amount": {"type": "integer", "description": "0 is no limit"},
+          "remaining": {"type": "integer"},
+          "granted": {"$ref": "#/definitions/timestamp"},
+          "status": {"enum": ["valid", "not_yet_valid", "expired", "exhausted"]}
+        }
+      }
+    },
+    "sessions": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["expires", "active"],
+        "properties": {
+          "expires": {"type": "integer", "description": "Unix UTC timestamp, 0 never expires"},
+          "active": {"type": "boolean"}
+        }
+      }
+    }
+  }
+}
+`
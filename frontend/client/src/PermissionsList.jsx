@@ -65,6 +65,18 @@ class PermissionsList extends React.Component {
                 case 2:
                     status = "Have a remote value"
                     break;
+                case 3:
+                    status = <button onClick={this.permissionMode.bind(this, item[0])} >Permission expired, renew</button>
+                    break;
+                case 4:
+                    status = <button onClick={this.permissionMode.bind(this, item[0])} >Permission used up, renew</button>
+                    break;
+                case 5:
+                    status = "Permission is not valid yet"
+                    break;
+                case 6:
+                    status = item[1].error || "Data could not be retrieved"
+                    break;
                 case -1:
                     status = <Permission done={this.mainMode.bind(this, item[0])} pid={item[0]} />
                     break;
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	pb "github.com/ice2heart/proxyu_client/serialize"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// historySweepInterval how often versions older than the retention are pruned
+	historySweepInterval = time.Hour
+	// retrievedSweepInterval how often retrieved versions of ended permissions are erased
+	retrievedSweepInterval = time.Minute
+)
+
+type historyMessage struct {
+	Version uint32 `json:"version"`
+	Written int64  `json:"written"`
+	Source  string `json:"source"`
+	Process string `json:"process,omitempty"`
+	Mime    string `json:"mime"`
+	Value   []byte `json:"value"`
+	Current bool   `json:"current"`
+}
+
+// makeGetHistory versions of a data item of the user, oldest first.
+// Values written before versioning have no history, deleted ones neither:
+// a delete request erases every version. Retrieved versions are listed while
+// their permission runs, they are never current.
+func makeGetHistory(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pubKey := sessionFrom(r.Context()).PubKey
+		dataID, err := ParseDataID(chi.URLParam(r, "id"))
+		if err != nil {
+			httpError(w, r, http.StatusNotFound, "error.unknown_data", err)
+			return
+		}
+		dataUUID := [16]byte(dataID)
+		versions, err := store.GetUserDataHistory(pubKey, &dataUUID)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, "error.internal", err)
+			return
+		}
+		perms, err := store.GetAllPermissions(pubKey)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, "error.internal", err)
+			return
+		}
+		versions = withoutLapsed(versions, retrievedKept(perms, time.Now()))
+		current := -1
+		for i, v := range versions {
+			if v.Source != pb.DataSource_RETRIEVE {
+				current = i
+			}
+		}
+		history := make([]historyMessage, len(versions))
+		for i, v := range versions {
+			history[i] = historyMessage{
+				Version: v.Version,
+				Written: v.Written,
+				Source:  strings.ToLower(v.Source.String()),
+				Mime:    v.Mime,
+				Value:   v.Value,
+				Current: i == current,
+			}
+			if len(v.Process) == 16 {
+				history[i].Process = uuid.UUID(dataIDOf(v.Process)).String()
+			}
+		}
+		render.JSON(w, r, history)
+	}
+}
+
+// sweepHistory prune versions older than retention, 0 keeps them forever
+func sweepHistory(ctx context.Context, store Store, retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(historySweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			removed, err := store.PruneUserDataHistory(now.Add(-retention))
+			if err != nil {
+				logrus.Errorf("History sweep failed: %v", err)
+				continue
+			}
+			if removed > 0 {
+				logrus.Infof("Pruned %d versions of user data", removed)
+			}
+		}
+	}
+}
+
+// retrievedKept data items whose retrieved versions are kept: the nodes of
+// running permissions and their leaves. A used up permission still runs.
+func retrievedKept(perms []*pb.Permission, now time.Time) map[DataID]bool {
+	kept := make(map[DataID]bool)
+	for _, perm := range perms {
+		if err := CheckPermission(perm, now); err != nil && !errors.Is(err, ErrPermissionExhausted) {
+			continue
+		}
+		data := [16]byte(dataIDOf(perm.GetData()))
+		for _, k := range deleteKeys(&data) {
+			kept[DataID(k)] = true
+		}
+	}
+	return kept
+}
+
+// withoutLapsed versions without the retrieved ones which are not kept any
+// more, sweepRetrieved erases them from the store a bit later
+func withoutLapsed(versions []UserData, kept map[DataID]bool) []UserData {
+	ret := versions[:0]
+	for _, v := range versions {
+		if v.Source != pb.DataSource_RETRIEVE || kept[DataID(v.Data)] {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// sweepRetrieved erase retrieved versions once their permission expired or
+// was replaced by one which is not valid yet
+func sweepRetrieved(ctx context.Context, store Store) {
+	ticker := time.NewTicker(retrievedSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			removed, err := store.PruneRetrievedHistory(now)
+			if err != nil {
+				logrus.Errorf("Retrieved data sweep failed: %v", err)
+				continue
+			}
+			if removed > 0 {
+				logrus.Infof("Erased %d retrieved versions of user data", removed)
+			}
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/ice2heart/proxyu_client/common"
+	pb "github.com/ice2heart/proxyu_client/serialize"
+	"github.com/sirupsen/logrus"
+)
+
+// importSkip mapping target of columns which are not imported
+const importSkip = "-"
+
+// importColumn data item a column is imported into
+type importColumn struct {
+	id   DataID
+	mime string
+}
+
+// importCell one value of a row, text is the cell as it was read
+type importCell struct {
+	column string
+	value  []byte
+	// json true if value is a JSON document of a JSON input
+	json bool
+}
+
+// importRow one customer, raw is kept for the reject file
+type importRow struct {
+	number int
+	key    string
+	cells  []importCell
+	csv    []string
+	json   json.RawMessage
+}
+
+// importer validates rows and writes them in batches
+type importer struct {
+	store     Store
+	keyColumn string
+	mapping   map[string]string
+	process   []byte
+	batchSize int
+
+	columns   map[string]*importColumn
+	nodeMimes map[DataID]string
+
+	batch     []UserDataWrite
+	batchRows []*importRow
+	reject    func(row *importRow, err error) error
+
+	rows, imported, rejected, values int
+}
+
+// importCmd `import [flags] <file.csv|file.json>` bulk load user data
+func importCmd(args []string) {
+	fs := newFlagSet("import", "[flags] <file.csv|file.json>")
+	format := fs.String("format", "", "Input format csv or json, by file extension if empty")
+	keyColumn := fs.String("key-column", "public_key", "Column with the base64 public key of the data subject")
+	mapping := fs.String("map", "", "Comma separated column=data pairs, data is a UUID, a dev name or - to skip the column. Columns are data UUIDs or dev names otherwise")
+	batchSize := fs.Int("batch", 500, "Rows written per transaction")
+	dryRun := fs.Bool("dry-run", false, "Validate rows without writing them")
+	rejectPath := fs.String("reject", "", "File for rows which can not be imported, <file>.rejects.<ext> if empty")
+	path := parseArgs(fs, args, 1, 1)[0]
+	if *batchSize < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	if *format != "csv" && *format != "json" {
+		logrus.Fatalf("unknown import format %q, use -format csv or json", *format)
+	}
+	if *rejectPath == "" {
+		*rejectPath = strings.TrimSuffix(path, filepath.Ext(path)) + ".rejects." + *format
+	}
+
+	if err := ReloadDAG(); err != nil {
+		logrus.Fatal(err)
+	}
+	imp := &importer{
+		keyColumn: *keyColumn,
+		mapping:   make(map[string]string),
+		process:   common.UUID2bytes(*processUUID),
+		batchSize: *batchSize,
+		columns:   make(map[string]*importColumn),
+		nodeMimes: make(map[DataID]string),
+	}
+	for _, node := range currentDAG().YAML.Didgraph {
+		if u, err := uuid.Parse(node.Key); err == nil {
+			imp.nodeMimes[DataID(u)] = node.Mime
+		}
+	}
+	for _, pair := range strings.Split(*mapping, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			logrus.Fatalf("-map %q is not column=data", pair)
+		}
+		imp.mapping[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	if !*dryRun {
+		store, err := openStore()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer store.Close()
+		imp.store = store
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer in.Close()
+	rejects, err := os.OpenFile(*rejectPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer rejects.Close()
+
+	if *format == "csv" {
+		err = imp.readCSV(in, rejects)
+	} else {
+		err = imp.readJSON(in, rejects)
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if *dryRun {
+		fmt.Println("dry run, nothing was written")
+	}
+	fmt.Printf("rows: %d\nimported: %d\nrejected: %d\nvalues: %d\n", imp.rows, imp.imported, imp.rejected, imp.values)
+	if imp.rejected > 0 {
+		fmt.Printf("rejects: %s\n", *rejectPath)
+	}
+}
+
+// readCSV header row names the columns, rejects get an error column.
+// The last batch is written before it returns.
+func (imp *importer) readCSV(in io.Reader, rejects io.Writer) error {
+	r := csv.NewReader(in)
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("csv header: %w", err)
+	}
+	keyIndex := -1
+	for i, name := range header {
+		if name == imp.keyColumn {
+			keyIndex = i
+			continue
+		}
+		// All rows would be rejected
+		if _, err := imp.column(name); err != nil {
+			return err
+		}
+	}
+	if keyIndex < 0 {
+		return fmt.Errorf("csv header has no %s column", imp.keyColumn)
+	}
+
+	w := csv.NewWriter(rejects)
+	defer w.Flush()
+	if err := w.Write(append(append([]string(nil), header...), "error")); err != nil {
+		return err
+	}
+	imp.reject = func(row *importRow, err error) error {
+		return w.Write(append(row.csv, err.Error()))
+	}
+	for number := 1; ; number++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			if err := imp.flush(); err != nil {
+				return err
+			}
+			w.Flush()
+			return w.Error()
+		}
+		row := &importRow{number: number, csv: record}
+		if errors.Is(err, csv.ErrFieldCount) {
+			if err := imp.rejectRow(row, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for i, cell := range record {
+			if i == keyIndex {
+				row.key = cell
+			} else if cell != "" {
+				row.cells = append(row.cells, importCell{column: header[i], value: []byte(cell)})
+			}
+		}
+		if err := imp.add(row); err != nil {
+			return err
+		}
+	}
+}
+
+// readJSON array of objects, rejects are JSON lines with row number and error.
+// The last batch is written before it returns.
+func (imp *importer) readJSON(in io.Reader, rejects io.Writer) error {
+	dec := json.NewDecoder(in)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return errors.New("json input must be an array of objects")
+	}
+	enc := json.NewEncoder(rejects)
+	imp.reject = func(row *importRow, err error) error {
+		return enc.Encode(struct {
+			Row   int             `json:"row"`
+			Error string          `json:"error"`
+			Data  json.RawMessage `json:"data"`
+		}{row.number, err.Error(), row.json})
+	}
+	for number := 1; dec.More(); number++ {
+		row := &importRow{number: number}
+		if err := dec.Decode(&row.json); err != nil {
+			return fmt.Errorf("row %d: %w", number, err)
+		}
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(row.json, &object); err != nil {
+			if err := imp.rejectRow(row, errors.New("row is not an object")); err != nil {
+				return err
+			}
+			continue
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			raw := object[name]
+			if name == imp.keyColumn {
+				json.Unmarshal(raw, &row.key)
+				continue
+			}
+			var text string
+			switch {
+			case string(raw) == "null":
+			case json.Unmarshal(raw, &text) == nil:
+				if text != "" {
+					row.cells = append(row.cells, importCell{column: name, value: []byte(text)})
+				}
+			default:
+				row.cells = append(row.cells, importCell{column: name, value: raw, json: true})
+			}
+		}
+		if err := imp.add(row); err != nil {
+			return err
+		}
+	}
+	return imp.flush()
+}
+
+// column resolve data item of a column, nil if the column is skipped
+func (imp *importer) column(name string) (*importColumn, error) {
+	if col, ok := imp.columns[name]; ok {
+		return col, nil
+	}
+	target := name
+	if mapped, ok := imp.mapping[name]; ok {
+		target = mapped
+	}
+	var col *importColumn
+	if target != importSkip {
+		id, err := ParseDataID(target)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", name, err)
+		}
+		dataUUID := [16]byte(id)
+		if !IsDAGLeaf(&dataUUID) {
+			return nil, fmt.Errorf("column %s: %v is not a leaf of the didgraph", name, id)
+		}
+		col = &importColumn{id: id, mime: imp.nodeMimes[id]}
+	}
+	imp.columns[name] = col
+	return col, nil
+}
+
+// add validate row, it is rejected as a whole if one of its values is invalid
+func (imp *importer) add(row *importRow) error {
+	key := common.S2B(row.key)
+	if len(key) != 32 {
+		return imp.rejectRow(row, fmt.Errorf("%s must be 32 bytes in base64", imp.keyColumn))
+	}
+	var writes []UserDataWrite
+	for _, cell := range row.cells {
+		col, err := imp.column(cell.column)
+		if err != nil {
+			return imp.rejectRow(row, err)
+		}
+		if col == nil {
+			continue
+		}
+		value, err := importValue(col.mime, cell)
+		if err != nil {
+			return imp.rejectRow(row, fmt.Errorf("column %s: %w", cell.column, err))
+		}
+		w := UserDataWrite{Data: col.id, Mime: col.mime, Value: value, Source: pb.DataSource_LOCAL, Process: imp.process}
+		copy(w.Subject[:], key)
+		writes = append(writes, w)
+	}
+	if len(writes) == 0 {
+		return imp.rejectRow(row, errors.New("no values"))
+	}
+	imp.rows++
+	imp.batch = append(imp.batch, writes...)
+	imp.batchRows = append(imp.batchRows, row)
+	if len(imp.batchRows) >= imp.batchSize {
+		return imp.flush()
+	}
+	return nil
+}
+
+// importValue check value against the MIME type of the data. Binary values
+// are base64 in the input and must match their type.
+func importValue(mimeType string, cell importCell) ([]byte, error) {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return nil, fmt.Errorf("bad mime %q: %v", mimeType, err)
+	}
+	switch {
+	case mediaType == "application/json":
+		if !json.Valid(cell.value) {
+			return nil, errors.New("value is not valid JSON")
+		}
+		return cell.value, nil
+	case cell.json:
+		return nil, fmt.Errorf("JSON value for %s", mediaType)
+	case strings.HasPrefix(mediaType, "text/"):
+		if !utf8.Valid(cell.value) {
+			return nil, errors.New("value is not valid UTF-8")
+		}
+		return cell.value, nil
+	}
+	value := common.S2B(string(cell.value))
+	if len(value) == 0 {
+		return nil, fmt.Errorf("%s value must be base64", mediaType)
+	}
+	if detected := http.DetectContentType(value); detected != mediaType {
+		return nil, fmt.Errorf("value is %s, not %s", detected, mediaType)
+	}
+	return value, nil
+}
+
+func (imp *importer) rejectRow(row *importRow, err error) error {
+	imp.rows++
+	imp.rejected++
+	logrus.Debugf("Row %d rejected: %v", row.number, err)
+	return imp.reject(row, err)
+}
+
+// flush write the batch in one transaction, all its rows are rejected if it fails
+func (imp *importer) flush() error {
+	if len(imp.batchRows) == 0 {
+		return nil
+	}
+	var err error
+	if imp.store != nil {
+		err = imp.store.WriteUserDataBatch(imp.batch)
+	}
+	if err != nil {
+		logrus.Errorf("Batch of %d rows failed: %v", len(imp.batchRows), err)
+		for _, row := range imp.batchRows {
+			imp.rejected++
+			if err := imp.reject(row, err); err != nil {
+				return err
+			}
+		}
+	} else {
+		imp.imported += len(imp.batchRows)
+		imp.values += len(imp.batch)
+	}
+	imp.batch = imp.batch[:0]
+	imp.batchRows = imp.batchRows[:0]
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ice2heart/proxyu_client/common"
+	pb "github.com/ice2heart/proxyu_client/serialize"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/sha3"
+)
+
+// masterKeyEnv environment variable with the master keys if no file is given
+const masterKeyEnv = "DATAU_MASTER_KEY"
+
+// ErrUnknownKey record is encrypted with a key which is not loaded
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// Keyring master keys which wrap the data keys of the subjects. The first key
+// wraps new data keys, the others are kept to read data until rotate-keys.
+type Keyring struct {
+	keys []masterKey
+}
+
+// LoadKeyring base64 32 bytes keys, one per line of the file or comma
+// separated in DATAU_MASTER_KEY. nil if neither is set.
+func LoadKeyring(path string) (*Keyring, error) {
+	var fields []string
+	switch {
+	case path != "":
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				fields = append(fields, line)
+			}
+		}
+	case os.Getenv(masterKeyEnv) != "":
+		for _, field := range strings.Split(os.Getenv(masterKeyEnv), ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, field)
+			}
+		}
+	default:
+		return nil, nil
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("no master key")
+	}
+	k := &Keyring{}
+	for i, field := range fields {
+		raw := common.S2B(field)
+		if len(raw) != 32 {
+			return nil, fmt.Errorf("master key %d must be 32 bytes in base64", i+1)
+		}
+		aead, err := newAEAD(raw)
+		if err != nil {
+			return nil, err
+		}
+		fingerprint := sha3.Sum256(raw)
+		k.keys = append(k.keys, masterKey{id: hex.EncodeToString(fingerprint[:4]), aead: aead})
+	}
+	return k, nil
+}
+
+// CurrentID id of the key which wraps new data keys
+func (k *Keyring) CurrentID() string {
+	return k.keys[0].id
+}
+
+// newDataKey random data key of the subject wrapped with the current master key
+func (k *Keyring) newDataKey(subject []byte) (*pb.DataKey, cipher.AEAD, error) {
+	raw := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	current := k.keys[0]
+	wrapped, err := seal(current.aead, raw, subject)
+	if err != nil {
+		return nil, nil, err
+	}
+	dk := &pb.DataKey{
+		Id:          uuid.New().String(),
+		MasterKeyId: current.id,
+		Wrapped:     wrapped,
+		Created:     time.Now().Unix(),
+	}
+	return dk, aead, nil
+}
+
+// unwrap cipher of a data key of the subject
+func (k *Keyring) unwrap(subject []byte, dk *pb.DataKey) (cipher.AEAD, error) {
+	for _, m := range k.keys {
+		if m.id != dk.GetMasterKeyId() {
+			continue
+		}
+		raw, err := open(m.aead, dk.GetWrapped(), subject)
+		if err != nil {
+			return nil, fmt.Errorf("unwrap data key %s: %w", dk.GetId(), err)
+		}
+		return newAEAD(raw)
+	}
+	return nil, fmt.Errorf("%w: master key %s", ErrUnknownKey, dk.GetMasterKeyId())
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal random nonce followed by the ciphertext, aad binds it to its record
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
+
+// rotateKeysCmd `rotate-keys` re-encrypt the Data bucket with new data keys
+// wrapped by the first master key. Run it with the server stopped. Free pages
+// of the file keep the old values until `db compact`.
+func rotateKeysCmd(args []string) {
+	parseArgs(newFlagSet("rotate-keys", ""), args, 0, 0)
+	if *storageBackend != "bolt" {
+		logrus.Fatalf("rotate-keys supports the bolt storage only, not %s", *storageBackend)
+	}
+	keys, err := LoadKeyring(*masterKeyFile)
+	if err != nil {
+		logrus.Fatalf("master key: %v", err)
+	}
+	if keys == nil {
+		logrus.Fatalf("set -master-key or %s", masterKeyEnv)
+	}
+	store, err := NewBoltStore(*userDataDB, keys)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer store.Close()
+	subjects, values, err := store.RotateKeys()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	fmt.Printf("master key: %s\nsubjects: %d\nvalues: %d\n", keys.CurrentID(), subjects, values)
+}
@@ -0,0 +1,150 @@
+// Package l10n loads the translation files and negotiates the language of a request
+package l10n
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"golang.org/x/text/language"
+	"gopkg.in/yaml.v2"
+)
+
+// DevName file with the developer names of the data, it is not a language
+const DevName = "dev"
+
+// Translation labels of the data UUIDs and messages of one language
+type Translation struct {
+	Tag      language.Tag
+	labels   map[[16]byte]string
+	messages map[string]string
+	fallback *Translation
+}
+
+// Catalog all loaded translations
+type Catalog struct {
+	translations []*Translation
+	matcher      language.Matcher
+}
+
+// Load every <lang>.yml of the directory. Keys which are UUIDs are labels of
+// the data, other keys are messages. defaultLang is used when nothing matches,
+// it picks the closest translation, e.g. en for en-US.
+func Load(dir string, defaultLang string) (*Catalog, error) {
+	defaultTag, err := language.Parse(defaultLang)
+	if err != nil {
+		return nil, fmt.Errorf("default language: %w", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.yml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	c := &Catalog{}
+	var tags []language.Tag
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".yml")
+		if name == DevName {
+			continue
+		}
+		tag, err := language.Parse(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: language: %w", path, err)
+		}
+		t, err := loadTranslation(path, tag)
+		if err != nil {
+			return nil, err
+		}
+		c.translations = append(c.translations, t)
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("%s: no translations", dir)
+	}
+	_, index, confidence := language.NewMatcher(tags).Match(defaultTag)
+	if confidence == language.No {
+		return nil, fmt.Errorf("%s: no translation for default language %s", dir, defaultLang)
+	}
+	def := c.translations[index]
+	// The matcher falls back to the first tag
+	c.translations = append([]*Translation{def}, append(c.translations[:index:index], c.translations[index+1:]...)...)
+	for i, t := range c.translations {
+		tags[i] = t.Tag
+		if t != def {
+			t.fallback = def
+		}
+	}
+	c.matcher = language.NewMatcher(tags)
+	return c, nil
+}
+
+func loadTranslation(path string, tag language.Tag) (*Translation, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	t := &Translation{Tag: tag, labels: make(map[[16]byte]string), messages: make(map[string]string)}
+	for k, v := range m {
+		if id, err := uuid.Parse(k); err == nil {
+			t.labels[id] = v
+			continue
+		}
+		t.messages[k] = v
+	}
+	return t, nil
+}
+
+// Match pick translation, the lang parameter is preferred over
+// the Accept-Language header
+func (c *Catalog) Match(lang, acceptLanguage string) *Translation {
+	if c == nil {
+		return nil
+	}
+	var tags []language.Tag
+	if lang != "" {
+		if tag, err := language.Parse(lang); err == nil {
+			tags = append(tags, tag)
+		}
+	}
+	if accepted, _, err := language.ParseAcceptLanguage(acceptLanguage); err == nil {
+		tags = append(tags, accepted...)
+	}
+	_, index, _ := c.matcher.Match(tags...)
+	return c.translations[index]
+}
+
+// Languages tags of the loaded translations, default first
+func (c *Catalog) Languages() []language.Tag {
+	tags := make([]language.Tag, len(c.translations))
+	for i, t := range c.translations {
+		tags[i] = t.Tag
+	}
+	return tags
+}
+
+// Label of the data, from the default language if it is not translated
+func (t *Translation) Label(id [16]byte) (string, bool) {
+	for ; t != nil; t = t.fallback {
+		if label, ok := t.labels[id]; ok {
+			return label, true
+		}
+	}
+	return "", false
+}
+
+// Message by key, from the default language if it is not translated
+func (t *Translation) Message(key string) (string, bool) {
+	for ; t != nil; t = t.fallback {
+		if msg, ok := t.messages[key]; ok {
+			return msg, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,47 @@
+package l10n
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/text/language"
+)
+
+func writeTranslations(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".yml"), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadDefaultLanguage(t *testing.T) {
+	dir := writeTranslations(t, map[string]string{
+		"de":    "greeting: Hallo\n",
+		"en":    "greeting: Hello\n",
+		DevName: "greeting: hello\n",
+	})
+	for _, lang := range []string{"en", "en-US", "en_GB"} {
+		c, err := Load(dir, lang)
+		if err != nil {
+			t.Fatalf("%s: %v", lang, err)
+		}
+		if tags := c.Languages(); len(tags) != 2 || tags[0] != language.English {
+			t.Fatalf("%s: languages %v, want en first", lang, tags)
+		}
+		// Nothing matches, the default is used
+		if msg, _ := c.Match("fr", "").Message("greeting"); msg != "Hello" {
+			t.Fatalf("%s: fallback message %q", lang, msg)
+		}
+		if msg, _ := c.Match("", "de-AT").Message("greeting"); msg != "Hallo" {
+			t.Fatalf("%s: de-AT message %q", lang, msg)
+		}
+	}
+	if _, err := Load(dir, "fr"); err == nil {
+		t.Fatal("default language without a translation was accepted")
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/ice2heart/proxyu_client/serialize"
+	"google.golang.org/protobuf/proto"
+)
+
+// MemoryStore Store kept in memory, for tests and local experiments
+type MemoryStore struct {
+	mu          sync.Mutex
+	data        map[[32]byte]map[[16]byte]UserData
+	history     map[[32]byte]map[[16]byte][]UserData
+	permissions map[[32]byte]map[[16]byte]*pb.Permission
+	sessions    map[[16]byte]*pb.UserInfo
+	documents   []*pb.Document
+}
+
+// NewMemoryStore empty store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		data:        make(map[[32]byte]map[[16]byte]UserData),
+		history:     make(map[[32]byte]map[[16]byte][]UserData),
+		permissions: make(map[[32]byte]map[[16]byte]*pb.Permission),
+		sessions:    make(map[[16]byte]*pb.UserInfo),
+	}
+}
+
+// WriteUserData replace value of the data, the value is appended to its history
+func (s *MemoryStore) WriteUserData(subject *[32]byte, data *[16]byte, mime *string, payload []byte, source pb.DataSource, process []byte) error {
+	return s.WriteUserDataBatch([]UserDataWrite{{
+		Subject: *subject,
+		Data:    *data,
+		Mime:    *mime,
+		Value:   payload,
+		Source:  source,
+		Process: process,
+	}})
+}
+
+// WriteUserDataBatch write all values at once
+func (s *MemoryStore) WriteUserDataBatch(writes []UserDataWrite) error {
+	s.putUserData(writes, true)
+	return nil
+}
+
+// AppendUserDataHistory add values to the history of the data only
+func (s *MemoryStore) AppendUserDataHistory(writes []UserDataWrite) error {
+	s.putUserData(writes, false)
+	return nil
+}
+
+// putUserData append the values to the history, current makes them the current values
+func (s *MemoryStore) putUserData(writes []UserDataWrite, current bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range writes {
+		history, ok := s.history[w.Subject]
+		if !ok {
+			history = make(map[[16]byte][]UserData)
+			s.history[w.Subject] = history
+		}
+		var version uint32 = 1
+		if versions := history[w.Data]; len(versions) > 0 {
+			version = versions[len(versions)-1].Version + 1
+		}
+		item := UserData{
+			Data:    w.Data,
+			Mime:    w.Mime,
+			Value:   append([]byte(nil), w.Value...),
+			Version: version,
+			Written: time.Now().Unix(),
+			Source:  w.Source,
+			Process: append([]byte(nil), w.Process...),
+		}
+		history[w.Data] = append(history[w.Data], item)
+		if !current {
+			continue
+		}
+		items, ok := s.data[w.Subject]
+		if !ok {
+			items = make(map[[16]byte]UserData)
+			s.data[w.Subject] = items
+		}
+		items[w.Data] = item
+	}
+}
+
+// GetAllUserData all data of the subject, ordered by data UUID
+func (s *MemoryStore) GetAllUserData(subject *[32]byte) (ret []UserData, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, item := range s.data[*subject] {
+		item.Value = append([]byte(nil), item.Value...)
+		ret = append(ret, item)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].Data[:], ret[j].Data[:]) < 0
+	})
+	return
+}
+
+// ExtractUserData value and mime of the data, ErrDataNotFound if it is not stored
+func (s *MemoryStore) ExtractUserData(subject *[32]byte, data *[16]byte) (payload []byte, mime string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.data[*subject][*data]
+	if !ok {
+		return nil, "", ErrDataNotFound
+	}
+	return append([]byte(nil), item.Value...), item.Mime, nil
+}
+
+// DeleteUserData remove data and all leaves of the node with their history
+func (s *MemoryStore) DeleteUserData(subject *[32]byte, data *[16]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := s.data[*subject]
+	found := false
+	for _, k := range deleteKeys(data) {
+		delete(s.history[*subject], k)
+		if _, ok := items[k]; ok {
+			found = true
+			delete(items, k)
+		}
+	}
+	if !found {
+		return ErrDataNotFound
+	}
+	return nil
+}
+
+// GetUserDataHistory all versions of the data, oldest first. Versions retrieved
+// from remote clients are never current.
+func (s *MemoryStore) GetUserDataHistory(subject *[32]byte, data *[16]byte) (ret []UserData, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, item := range s.history[*subject][*data] {
+		item.Value = append([]byte(nil), item.Value...)
+		ret = append(ret, item)
+	}
+	return
+}
+
+// PruneUserDataHistory remove versions written before the time, except the
+// current ones. Returns how many were removed.
+func (s *MemoryStore) PruneUserDataHistory(before time.Time) (removed int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for subject, history := range s.history {
+		for data, versions := range history {
+			current := s.data[subject][data].Version
+			kept := versions[:0]
+			for _, item := range versions {
+				if item.Version != current && item.Written < before.Unix() {
+					removed++
+					continue
+				}
+				kept = append(kept, item)
+			}
+			history[data] = kept
+		}
+	}
+	return
+}
+
+// PruneRetrievedHistory remove versions retrieved from remote clients which no
+// running permission of the subject covers. Returns how many were removed.
+func (s *MemoryStore) PruneRetrievedHistory(now time.Time) (removed int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for subject, history := range s.history {
+		var perms []*pb.Permission
+		for _, perm := range s.permissions[subject] {
+			perms = append(perms, perm)
+		}
+		kept := retrievedKept(perms, now)
+		for data, versions := range history {
+			if kept[DataID(data)] {
+				continue
+			}
+			left := versions[:0]
+			for _, item := range versions {
+				if item.Source == pb.DataSource_RETRIEVE {
+					removed++
+					continue
+				}
+				left = append(left, item)
+			}
+			history[data] = left
+		}
+	}
+	return
+}
+
+// WritePermission store granted permission, replaces the previous one for the data
+func (s *MemoryStore) WritePermission(perm *pb.Permission) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var subject [32]byte
+	var data [16]byte
+	copy(subject[:], perm.PublicKey)
+	copy(data[:], perm.Data)
+	perm.Remaining = perm.Amount
+	perms, ok := s.permissions[subject]
+	if !ok {
+		perms = make(map[[16]byte]*pb.Permission)
+		s.permissions[subject] = perms
+	}
+	perms[data] = proto.Clone(perm).(*pb.Permission)
+	return nil
+}
+
+// GetAllPermissions all permissions granted by the subject, ordered by data UUID
+func (s *MemoryStore) GetAllPermissions(subject *[32]byte) (ret []*pb.Permission, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, perm := range s.permissions[*subject] {
+		ret = append(ret, proto.Clone(perm).(*pb.Permission))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].Data, ret[j].Data) < 0
+	})
+	return
+}
+
+// UsePermission check permission and count one retrieval
+func (s *MemoryStore) UsePermission(subject *[32]byte, data *[16]byte, now time.Time) (*pb.Permission, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	perm, ok := s.permissions[*subject][*data]
+	if !ok {
+		return nil, ErrPermissionNotFound
+	}
+	if err := CheckPermission(perm, now); err != nil {
+		return proto.Clone(perm).(*pb.Permission), err
+	}
+	if perm.GetAmount() > 0 {
+		perm.Remaining--
+	}
+	return proto.Clone(perm).(*pb.Permission), nil
+}
+
+// WriteSession for user, zero expires never expires
+func (s *MemoryStore) WriteSession(id *[16]byte, pubkey *[32]byte, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := &pb.UserInfo{
+		Uuid:   append([]byte(nil), id[:]...),
+		Pubkey: append([]byte(nil), pubkey[:]...),
+	}
+	if !expires.IsZero() {
+		m.Expires = expires.Unix()
+	}
+	s.sessions[*id] = m
+	return nil
+}
+
+// DeleteSession remove session, it is not an error if there is none
+func (s *MemoryStore) DeleteSession(id *[16]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, *id)
+	return nil
+}
+
+// GetSession public key of the session, nil if there is none or it is expired
+func (s *MemoryStore) GetSession(id *[16]byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[*id]
+	if !ok || sessionExpired(session, time.Now()) {
+		return nil
+	}
+	return append([]byte(nil), session.GetPubkey()...)
+}
+
+// GetSessions all sessions of the user, expired ones included
+func (s *MemoryStore) GetSessions(pubkey *[32]byte) (ret []*pb.UserInfo, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, session := range s.sessions {
+		if bytes.Equal(session.GetPubkey(), pubkey[:]) {
+			ret = append(ret, proto.Clone(session).(*pb.UserInfo))
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].Uuid, ret[j].Uuid) < 0
+	})
+	return
+}
+
+// DeleteSessions remove all sessions of the user, returns how many were removed
+func (s *MemoryStore) DeleteSessions(pubkey *[32]byte) (int, error) {
+	return s.deleteSessionsIf(func(session *pb.UserInfo) bool {
+		return bytes.Equal(session.GetPubkey(), pubkey[:])
+	}), nil
+}
+
+// PurgeExpiredSessions remove sessions expired before now, returns how many were removed
+func (s *MemoryStore) PurgeExpiredSessions(now time.Time) (int, error) {
+	return s.deleteSessionsIf(func(session *pb.UserInfo) bool {
+		return sessionExpired(session, now)
+	}), nil
+}
+
+func (s *MemoryStore) deleteSessionsIf(match func(*pb.UserInfo) bool) (removed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if match(session) {
+			delete(s.sessions, id)
+			removed++
+		}
+	}
+	return
+}
+
+// WriteDocument store submitted document as the next version
+func (s *MemoryStore) WriteDocument(doc *pb.Document) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc.Version = uint32(len(s.documents) + 1)
+	s.documents = append(s.documents, proto.Clone(doc).(*pb.Document))
+	return nil
+}
+
+// GetDocuments all submitted documents, oldest first
+func (s *MemoryStore) GetDocuments() (ret []*pb.Document, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, doc := range s.documents {
+		ret = append(ret, proto.Clone(doc).(*pb.Document))
+	}
+	return
+}
+
+// GetCurrentDocument latest document accepted by proxyU, nil if none
+func (s *MemoryStore) GetCurrentDocument() *pb.Document {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.documents) - 1; i >= 0; i-- {
+		if s.documents[i].GetOk() {
+			return proto.Clone(s.documents[i]).(*pb.Document)
+		}
+	}
+	return nil
+}
+
+// Stats record counts
+func (s *MemoryStore) Stats(now time.Time) (stats StoreStats, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, items := range s.data {
+		if len(items) > 0 {
+			stats.Subjects++
+		}
+		stats.Values += len(items)
+	}
+	for _, history := range s.history {
+		for _, versions := range history {
+			stats.Versions += len(versions)
+		}
+	}
+	for _, perms := range s.permissions {
+		stats.Permissions += len(perms)
+	}
+	for _, session := range s.sessions {
+		if sessionExpired(session, now) {
+			stats.ExpiredSessions++
+		} else {
+			stats.Sessions++
+		}
+	}
+	stats.Documents = len(s.documents)
+	return
+}
+
+// Close nothing to release
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ice2heart/proxyu_client/common"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// PermissionProfile parameters and allowed bounds of a permission request for a data item.
+// Zero MaxDuration and MaxAmount mean no bound, zero MaxDelay starts every permission now.
+type PermissionProfile struct {
+	Reason      string        `yaml:"reason"`
+	Duration    time.Duration `yaml:"duration"`
+	MaxDuration time.Duration `yaml:"max_duration"`
+	MaxDelay    time.Duration `yaml:"max_delay"`
+	Amount      uint32        `yaml:"amount"`
+	MaxAmount   uint32        `yaml:"max_amount"`
+	Level       uint32        `yaml:"level"`
+	MinLevel    uint32        `yaml:"min_level"`
+	MaxLevel    uint32        `yaml:"max_level"`
+}
+
+// permissionParams values for a pb.PermissionRequest
+type permissionParams struct {
+	Reason []byte
+	From   uint64
+	Until  uint64
+	Amount uint32
+	Level  uint32
+}
+
+// PermissionProfiles default profile and overrides per data UUID
+type PermissionProfiles struct {
+	Default  PermissionProfile
+	Profiles map[[16]byte]PermissionProfile
+}
+
+// permissionsYAML profiles only list the fields that differ from default
+type permissionsYAML struct {
+	Default  PermissionProfile        `yaml:"default"`
+	Profiles map[string]yaml.MapSlice `yaml:"profiles"`
+}
+
+var (
+	defaultPermissionProfile = PermissionProfile{
+		Reason:   "323fd1ea-76c7-4069-8fb1-d223f816c927",
+		Duration: 5 * 365 * 24 * time.Hour,
+		MaxDelay: 30 * 24 * time.Hour,
+		Level:    1,
+		MinLevel: 1,
+		MaxLevel: 1,
+	}
+	permissionProfiles = PermissionProfiles{Default: defaultPermissionProfile}
+)
+
+// ParsePermissionsYML load permission profiles, built-in default is used if file is absent
+func ParsePermissionsYML(path *string) (PermissionProfiles, error) {
+	result := PermissionProfiles{Default: defaultPermissionProfile, Profiles: make(map[[16]byte]PermissionProfile)}
+	data, err := ioutil.ReadFile(*path)
+	if os.IsNotExist(err) {
+		logrus.Warnf("%s not found, default permission profile is used", *path)
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	parsed := permissionsYAML{Default: defaultPermissionProfile}
+	if err := yaml.UnmarshalStrict(data, &parsed); err != nil {
+		return result, err
+	}
+	if err := parsed.Default.validate(); err != nil {
+		return result, fmt.Errorf("default: %w", err)
+	}
+	result.Default = parsed.Default
+	for key, fields := range parsed.Profiles {
+		id, err := uuid.Parse(key)
+		if err != nil {
+			return result, fmt.Errorf("profile %s: %w", key, err)
+		}
+		// Overlay the profile fields on top of the default
+		raw, err := yaml.Marshal(fields)
+		if err != nil {
+			return result, fmt.Errorf("profile %s: %w", key, err)
+		}
+		profile := parsed.Default
+		if err := yaml.UnmarshalStrict(raw, &profile); err != nil {
+			return result, fmt.Errorf("profile %s: %w", key, err)
+		}
+		if err := profile.validate(); err != nil {
+			return result, fmt.Errorf("profile %s: %w", key, err)
+		}
+		result.Profiles[id] = profile
+	}
+	return result, nil
+}
+
+// Get profile for data item
+func (p PermissionProfiles) Get(data *[16]byte) PermissionProfile {
+	if profile, ok := p.Profiles[*data]; ok {
+		return profile
+	}
+	return p.Default
+}
+
+func (p PermissionProfile) validate() error {
+	if _, err := uuid.Parse(p.Reason); err != nil {
+		return fmt.Errorf("reason: %w", err)
+	}
+	if p.Duration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	if p.MaxDuration > 0 && p.Duration > p.MaxDuration {
+		return fmt.Errorf("duration %v is above max_duration %v", p.Duration, p.MaxDuration)
+	}
+	if p.MaxDelay < 0 {
+		return fmt.Errorf("max_delay must not be negative")
+	}
+	if p.MaxAmount > 0 && (p.Amount == 0 || p.Amount > p.MaxAmount) {
+		return fmt.Errorf("amount %d is outside of 1..%d", p.Amount, p.MaxAmount)
+	}
+	if p.MinLevel > p.MaxLevel {
+		return fmt.Errorf("min_level %d is above max_level %d", p.MinLevel, p.MaxLevel)
+	}
+	if p.Level < p.MinLevel || p.Level > p.MaxLevel {
+		return fmt.Errorf("level %d is outside of %d..%d", p.Level, p.MinLevel, p.MaxLevel)
+	}
+	return nil
+}
+
+// Params build request parameters, `from`, `until`, `amount` and `level`
+// query values override the profile within its bounds. `from` later than
+// MaxDelay from now is moved back to it.
+func (p PermissionProfile) Params(query url.Values, now time.Time) (params permissionParams, err error) {
+	params.Reason = common.UUID2bytes(p.Reason)
+	params.Amount = p.Amount
+	params.Level = p.Level
+	params.From = uint64(now.Unix())
+	if v := query.Get("from"); v != "" {
+		if params.From, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return params, fmt.Errorf("from: %w", err)
+		}
+		if params.From < uint64(now.Unix()) {
+			return params, fmt.Errorf("from is in the past")
+		}
+		if latest := uint64(now.Add(p.MaxDelay).Unix()); params.From > latest {
+			params.From = latest
+		}
+	}
+	params.Until = params.From + uint64(p.Duration/time.Second)
+	if v := query.Get("until"); v != "" {
+		if params.Until, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return params, fmt.Errorf("until: %w", err)
+		}
+		if params.Until <= params.From {
+			return params, fmt.Errorf("until must be after from")
+		}
+	}
+	if p.MaxDuration > 0 && params.Until-params.From > uint64(p.MaxDuration/time.Second) {
+		return params, fmt.Errorf("permission is longer than %v", p.MaxDuration)
+	}
+	if v := query.Get("amount"); v != "" {
+		amount, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return params, fmt.Errorf("amount: %w", err)
+		}
+		params.Amount = uint32(amount)
+		if p.MaxAmount > 0 && (params.Amount == 0 || params.Amount > p.MaxAmount) {
+			return params, fmt.Errorf("amount is outside of 1..%d", p.MaxAmount)
+		}
+	}
+	if v := query.Get("level"); v != "" {
+		level, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return params, fmt.Errorf("level: %w", err)
+		}
+		params.Level = uint32(level)
+		if params.Level < p.MinLevel || params.Level > p.MaxLevel {
+			return params, fmt.Errorf("level is outside of %d..%d", p.MinLevel, p.MaxLevel)
+		}
+	}
+	return params, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPermissionParamsFrom(t *testing.T) {
+	profile := defaultPermissionProfile
+	profile.Duration = 24 * time.Hour
+	profile.MaxDelay = time.Hour
+	now := time.Unix(1700000000, 0)
+	start, latest := uint64(now.Unix()), uint64(now.Add(time.Hour).Unix())
+	day := uint64(24 * 60 * 60)
+
+	tests := []struct {
+		name      string
+		from      uint64
+		wantFrom  uint64
+		wantUntil uint64
+	}{
+		{"now", start, start, start + day},
+		{"within max_delay", start + 60, start + 60, start + 60 + day},
+		{"at max_delay", latest, latest, latest + day},
+		{"after max_delay", start + 365*day, latest, latest + day},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := url.Values{"from": {strconv.FormatUint(tt.from, 10)}}
+			params, err := profile.Params(query, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if params.From != tt.wantFrom || params.Until != tt.wantUntil {
+				t.Fatalf("got %d..%d, want %d..%d", params.From, params.Until, tt.wantFrom, tt.wantUntil)
+			}
+		})
+	}
+}
+
+func TestPermissionParamsFromBounds(t *testing.T) {
+	profile := defaultPermissionProfile
+	profile.Duration = 24 * time.Hour
+	profile.MaxDuration = 48 * time.Hour
+	profile.MaxDelay = time.Hour
+	now := time.Unix(1700000000, 0)
+
+	if _, err := profile.Params(url.Values{"from": {strconv.FormatUint(uint64(now.Unix())-1, 10)}}, now); err == nil {
+		t.Fatal("from in the past was accepted")
+	}
+	// The window can not be moved past max_delay with an explicit until
+	far := uint64(now.Add(100 * 24 * time.Hour).Unix())
+	query := url.Values{"from": {strconv.FormatUint(far, 10)}, "until": {strconv.FormatUint(far+3600, 10)}}
+	if _, err := profile.Params(query, now); err == nil {
+		t.Fatal("until beyond max_delay and max_duration was accepted")
+	}
+
+	profile.MaxDelay = 0
+	params, err := profile.Params(url.Values{"from": {strconv.FormatUint(far, 10)}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.From != uint64(now.Unix()) {
+		t.Fatalf("zero max_delay: from %d, want now", params.From)
+	}
+}
@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error number used in the `error` field of the Data messages
+type Error int32
+
+// Error numbers from the integration protocol specification
+const (
+	ErrNotFound           Error = -1
+	ErrNotAllowed         Error = -2
+	ErrInternal           Error = -3
+	ErrPermissionNotFound Error = -4
+)
+
+func (e Error) Error() string {
+	switch e {
+	case ErrNotFound:
+		return "not found"
+	case ErrNotAllowed:
+		return "not allowed for legal reasons"
+	case ErrInternal:
+		return "internal server error"
+	case ErrPermissionNotFound:
+		return "permission is not found"
+	}
+	return fmt.Sprintf("unknown error %d", int32(e))
+}
+
+// Is unknown numbers are treated as internal errors
+func (e Error) Is(target error) bool {
+	t, ok := target.(Error)
+	if !ok {
+		return false
+	}
+	if t == ErrInternal && !e.known() {
+		return true
+	}
+	return e == t
+}
+
+func (e Error) known() bool {
+	return e >= ErrPermissionNotFound && e <= ErrNotFound
+}
+
+// ErrorFromCode convert error field of a message to error, 0 is nil
+func ErrorFromCode(code int32) error {
+	if code == 0 {
+		return nil
+	}
+	return Error(code)
+}
+
+// CodeFromError convert error to the error field of a message.
+// Errors not wrapping Error are reported as ErrInternal.
+func CodeFromError(err error) int32 {
+	if err == nil {
+		return 0
+	}
+	var e Error
+	if errors.As(err, &e) {
+		return int32(e)
+	}
+	return int32(ErrInternal)
+}
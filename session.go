@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/ice2heart/proxyu_client/common"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	sessionName = "datau_session"
+	// session values
+	sessionIDKey = "id"
+)
+
+var (
+	sessionStore *sessions.CookieStore
+	sessionTTL   time.Duration
+	// errNoSession request has no valid session cookie
+	errNoSession = errors.New("no session")
+	// errNotAuthenticated session is not correlated with a user yet
+	errNotAuthenticated = errors.New("session is not authenticated")
+)
+
+type sessionContextKey struct{}
+
+// userSession session of the request, set by withSession and requireAuth
+type userSession struct {
+	ID [16]byte
+	// PubKey nil until the session is correlated
+	PubKey *[32]byte
+}
+
+// newSessionStore cookie store signed and encrypted with the configured keys
+func newSessionStore(hashKey, blockKey string, maxAge time.Duration, secure bool) (*sessions.CookieStore, error) {
+	hash, err := sessionKey(hashKeySpec, hashKey, 64)
+	if err != nil {
+		return nil, err
+	}
+	block, err := sessionKey(blockKeySpec, blockKey, 32)
+	if err != nil {
+		return nil, err
+	}
+	store := sessions.NewCookieStore(hash, block)
+	store.Options = &sessions.Options{
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	// Sets cookie expiry and the timestamp check of the codecs
+	store.MaxAge(int(maxAge / time.Second))
+	sessionTTL = maxAge
+	return store, nil
+}
+
+// sessionKeySpec setting of a session key and its valid sizes
+type sessionKeySpec struct {
+	name  string
+	sizes string
+	valid map[int]bool
+}
+
+var (
+	hashKeySpec  = sessionKeySpec{"session-hash-key", "32 or 64", map[int]bool{32: true, 64: true}}
+	blockKeySpec = sessionKeySpec{"session-block-key", "16, 24 or 32", map[int]bool{16: true, 24: true, 32: true}}
+)
+
+// decode base64 key, error if it is not base64 or has a wrong size
+func (k sessionKeySpec) decode(value string) ([]byte, error) {
+	key := common.S2B(value)
+	if !k.valid[len(key)] {
+		return nil, fmt.Errorf("%s must be %s bytes in base64", k.name, k.sizes)
+	}
+	return key, nil
+}
+
+// sessionKey decode base64 key, random key of size bytes if it is not configured
+func sessionKey(spec sessionKeySpec, value string, size int) ([]byte, error) {
+	if value == "" {
+		logrus.Warnf("%s is not set, sessions will not survive a restart", spec.name)
+		return securecookie.GenerateRandomKey(size), nil
+	}
+	return spec.decode(value)
+}
+
+// getSessionID id of the browser session, errNoSession if there is none
+func getSessionID(r *http.Request) (id [16]byte, err error) {
+	session, err := sessionStore.Get(r, sessionName)
+	if err != nil {
+		return id, fmt.Errorf("%w: %v", errNoSession, err)
+	}
+	raw, ok := session.Values[sessionIDKey].([]byte)
+	if !ok || len(raw) != len(id) {
+		return id, errNoSession
+	}
+	copy(id[:], raw)
+	return id, nil
+}
+
+// withSession resolve the session into the request context, 401 if the
+// request has no session cookie
+func withSession(store Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session, err := resolveSession(store, r)
+			if err != nil {
+				httpError(w, r, http.StatusUnauthorized, "error.no_session", err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, session)))
+		})
+	}
+}
+
+// requireAuth like withSession, also 401 if the session is not correlated
+func requireAuth(store Store) func(http.Handler) http.Handler {
+	resolve := withSession(store)
+	return func(next http.Handler) http.Handler {
+		return resolve(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if sessionFrom(r.Context()).PubKey == nil {
+				httpError(w, r, http.StatusUnauthorized, "error.not_authenticated", errNotAuthenticated)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+// sessionFrom session resolved by the middleware, nil if there is none
+func sessionFrom(ctx context.Context) *userSession {
+	session, _ := ctx.Value(sessionContextKey{}).(*userSession)
+	return session
+}
+
+func resolveSession(store Store, r *http.Request) (*userSession, error) {
+	id, err := getSessionID(r)
+	if err != nil {
+		return nil, err
+	}
+	session := &userSession{ID: id}
+	if raw := store.GetSession(&id); len(raw) == 32 {
+		session.PubKey = new([32]byte)
+		copy(session.PubKey[:], raw)
+	}
+	return session, nil
+}
+
+// startSession new anonymous session, the cookie is set on w
+func startSession(w http.ResponseWriter, r *http.Request) (id [16]byte, err error) {
+	// Get returns a new session if the cookie is broken or expired
+	session, _ := sessionStore.Get(r, sessionName)
+	copy(id[:], common.RandomUUID())
+	session.Values[sessionIDKey] = id[:]
+	err = session.Save(r, w)
+	return
+}
+
+// moveSession carry a correlated session over to a new id, an anonymous one
+// has nothing to carry
+func moveSession(store Store, from, to *[16]byte) error {
+	raw := store.GetSession(from)
+	if len(raw) != 32 {
+		return nil
+	}
+	var pubKey [32]byte
+	copy(pubKey[:], raw)
+	if err := store.WriteSession(to, &pubKey, sessionExpires()); err != nil {
+		return err
+	}
+	return store.DeleteSession(from)
+}
+
+// sessionExpires expiry of a session correlated now
+func sessionExpires() time.Time {
+	return time.Now().Add(sessionTTL)
+}
+
+// makePostLogout remove the session and its cookie
+func makePostLogout(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id, err := getSessionID(r); err == nil {
+			if err := store.DeleteSession(&id); err != nil {
+				httpError(w, r, http.StatusInternalServerError, "error.internal", err)
+				return
+			}
+		}
+		session, _ := sessionStore.Get(r, sessionName)
+		session.Options.MaxAge = -1
+		if err := session.Save(r, w); err != nil {
+			logrus.Error(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type revokeSessionsMessage struct {
+	PublicKey string `json:"public_key"`
+}
+
+type revokedSessionsMessage struct {
+	Revoked int `json:"revoked"`
+}
+
+// makePostRevokeSessions log out every browser of the public key
+func makePostRevokeSessions(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var msg revokeSessionsMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			httpError(w, r, http.StatusBadRequest, "error.bad_request", err)
+			return
+		}
+		key := common.S2B(msg.PublicKey)
+		if len(key) != 32 {
+			httpError(w, r, http.StatusBadRequest, "error.bad_request", errors.New("public_key must be 32 bytes in base64"))
+			return
+		}
+		var pubKey [32]byte
+		copy(pubKey[:], key)
+		removed, err := store.DeleteSessions(&pubKey)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, "error.internal", err)
+			return
+		}
+		logrus.Infof("Revoked %d sessions of %s", removed, msg.PublicKey)
+		render.JSON(w, r, revokedSessionsMessage{Revoked: removed})
+	}
+}
+
+// sweepSessions purge expired sessions every interval
+func sweepSessions(ctx context.Context, store Store, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			removed, err := store.PurgeExpiredSessions(now)
+			if err != nil {
+				logrus.Errorf("Session sweep failed: %v", err)
+				continue
+			}
+			if removed > 0 {
+				logrus.Infof("Purged %d expired sessions", removed)
+			}
+		}
+	}
+}
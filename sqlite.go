@@ -0,0 +1,7 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+// The sqlite storage needs cgo, builds without it support bolt, postgres and memory
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/ice2heart/proxyu_client/serialize"
+
+	// database/sql drivers of the SQL backends
+	_ "github.com/lib/pq"
+)
+
+// sqlDialect differences between the supported databases
+type sqlDialect struct {
+	driver string
+	// lock serializes migrations of replicas starting together, empty if not needed
+	lock string
+	// numbered placeholders $1, $2 instead of ?
+	numbered   bool
+	migrations []string
+}
+
+var sqlDialects = map[string]*sqlDialect{
+	"postgres": {
+		driver:   "postgres",
+		lock:     "SELECT pg_advisory_xact_lock(7318246)",
+		numbered: true,
+		migrations: []string{
+			`CREATE TABLE user_data (
+				subject BYTEA NOT NULL,
+				data BYTEA NOT NULL,
+				mime TEXT NOT NULL,
+				value BYTEA NOT NULL,
+				PRIMARY KEY (subject, data)
+			);
+			CREATE TABLE session (
+				id BYTEA PRIMARY KEY,
+				pubkey BYTEA NOT NULL,
+				expires BIGINT NOT NULL DEFAULT 0
+			);
+			CREATE INDEX session_pubkey ON session (pubkey);
+			CREATE TABLE permission (
+				subject BYTEA NOT NULL,
+				data BYTEA NOT NULL,
+				process BYTEA,
+				reason BYTEA,
+				policy BYTEA,
+				valid_from BIGINT NOT NULL,
+				valid_until BIGINT NOT NULL,
+				amount INTEGER NOT NULL,
+				remaining INTEGER NOT NULL,
+				granted BIGINT NOT NULL,
+				PRIMARY KEY (subject, data)
+			);
+			CREATE TABLE document (
+				version SERIAL PRIMARY KEY,
+				url TEXT NOT NULL,
+				hash BYTEA,
+				submitted BIGINT NOT NULL,
+				ok BOOLEAN NOT NULL,
+				error TEXT NOT NULL
+			);`,
+			`CREATE TABLE user_data_history (
+				subject BYTEA NOT NULL,
+				data BYTEA NOT NULL,
+				version INTEGER NOT NULL,
+				mime TEXT NOT NULL,
+				value BYTEA NOT NULL,
+				written BIGINT NOT NULL,
+				source INTEGER NOT NULL,
+				process BYTEA,
+				PRIMARY KEY (subject, data, version)
+			);
+			CREATE INDEX user_data_history_written ON user_data_history (written);
+			ALTER TABLE user_data ADD COLUMN version INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE user_data ADD COLUMN written BIGINT NOT NULL DEFAULT 0;
+			ALTER TABLE user_data ADD COLUMN source INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE user_data ADD COLUMN process BYTEA;`,
+		},
+	},
+	"sqlite3": {
+		driver: "sqlite3",
+		migrations: []string{
+			`CREATE TABLE user_data (
+				subject BLOB NOT NULL,
+				data BLOB NOT NULL,
+				mime TEXT NOT NULL,
+				value BLOB NOT NULL,
+				PRIMARY KEY (subject, data)
+			);
+			CREATE TABLE session (
+				id BLOB PRIMARY KEY,
+				pubkey BLOB NOT NULL,
+				expires INTEGER NOT NULL DEFAULT 0
+			);
+			CREATE INDEX session_pubkey ON session (pubkey);
+			CREATE TABLE permission (
+				subject BLOB NOT NULL,
+				data BLOB NOT NULL,
+				process BLOB,
+				reason BLOB,
+				policy BLOB,
+				valid_from INTEGER NOT NULL,
+				valid_until INTEGER NOT NULL,
+				amount INTEGER NOT NULL,
+				remaining INTEGER NOT NULL,
+				granted INTEGER NOT NULL,
+				PRIMARY KEY (subject, data)
+			);
+			CREATE TABLE document (
+				version INTEGER PRIMARY KEY AUTOINCREMENT,
+				url TEXT NOT NULL,
+				hash BLOB,
+				submitted INTEGER NOT NULL,
+				ok BOOLEAN NOT NULL,
+				error TEXT NOT NULL
+			);`,
+			`CREATE TABLE user_data_history (
+				subject BLOB NOT NULL,
+				data BLOB NOT NULL,
+				version INTEGER NOT NULL,
+				mime TEXT NOT NULL,
+				value BLOB NOT NULL,
+				written INTEGER NOT NULL,
+				source INTEGER NOT NULL,
+				process BLOB,
+				PRIMARY KEY (subject, data, version)
+			);
+			CREATE INDEX user_data_history_written ON user_data_history (written);
+			ALTER TABLE user_data ADD COLUMN version INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE user_data ADD COLUMN written INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE user_data ADD COLUMN source INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE user_data ADD COLUMN process BLOB;`,
+		},
+	},
+}
+
+// SQLStore Store in Postgres, or SQLite for a single instance and tests
+type SQLStore struct {
+	db      *sql.DB
+	dialect *sqlDialect
+}
+
+// NewSQLStore connect and migrate the schema to the latest version.
+// dialect is postgres or sqlite3, dsn is passed to the driver.
+func NewSQLStore(dialect, dsn string) (*SQLStore, error) {
+	d, ok := sqlDialects[dialect]
+	if !ok {
+		return nil, fmt.Errorf("unknown sql dialect %q", dialect)
+	}
+	if !sqlDriverRegistered(d.driver) {
+		return nil, fmt.Errorf("%s driver is not built in, build with CGO_ENABLED=1", d.driver)
+	}
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if d.driver == "sqlite3" {
+		// SQLite allows one writer, concurrent ones fail with SQLITE_BUSY
+		db.SetMaxOpenConns(1)
+	}
+	s := &SQLStore{db: db, dialect: d}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	return s, nil
+}
+
+// sqlDriverRegistered false if the driver is left out of the build, sqlite3 needs cgo
+func sqlDriverRegistered(driver string) bool {
+	for _, name := range sql.Drivers() {
+		if name == driver {
+			return true
+		}
+	}
+	return false
+}
+
+// migrate apply the migrations which are not recorded in schema_migration
+func (s *SQLStore) migrate() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if s.dialect.lock != "" {
+		if _, err := tx.Exec(s.dialect.lock); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migration (version INTEGER PRIMARY KEY, applied BIGINT NOT NULL)`)
+	if err != nil {
+		return err
+	}
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migration`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(s.dialect.migrations); i++ {
+		if _, err := tx.Exec(s.dialect.migrations[i]); err != nil {
+			return fmt.Errorf("version %d: %w", i+1, err)
+		}
+		_, err := tx.Exec(s.rebind(`INSERT INTO schema_migration (version, applied) VALUES (?, ?)`), i+1, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// rebind replace ? placeholders for the dialect
+func (s *SQLStore) rebind(query string) string {
+	if !s.dialect.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *SQLStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(s.rebind(query), args...)
+}
+
+// WriteUserData replace value of the data, the value is appended to its history
+func (s *SQLStore) WriteUserData(subject *[32]byte, data *[16]byte, mime *string, payload []byte, source pb.DataSource, process []byte) error {
+	return s.WriteUserDataBatch([]UserDataWrite{{
+		Subject: *subject,
+		Data:    *data,
+		Mime:    *mime,
+		Value:   payload,
+		Source:  source,
+		Process: process,
+	}})
+}
+
+// WriteUserDataBatch write all values in one transaction
+func (s *SQLStore) WriteUserDataBatch(writes []UserDataWrite) error {
+	return s.putUserDataBatch(writes, true)
+}
+
+// AppendUserDataHistory add values to the history of the data only, in one transaction
+func (s *SQLStore) AppendUserDataHistory(writes []UserDataWrite) error {
+	return s.putUserDataBatch(writes, false)
+}
+
+func (s *SQLStore) putUserDataBatch(writes []UserDataWrite, current bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i := range writes {
+		if err := s.putUserData(tx, &writes[i], current); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// putUserData append the value to the history, current makes it the row in user_data
+func (s *SQLStore) putUserData(tx *sql.Tx, w *UserDataWrite, current bool) error {
+	payload := w.Value
+	if payload == nil {
+		payload = []byte{}
+	}
+	var version uint32
+	err := tx.QueryRow(s.rebind(`SELECT COALESCE(MAX(version), 0) + 1 FROM user_data_history WHERE subject = ? AND data = ?`),
+		w.Subject[:], w.Data[:]).Scan(&version)
+	if err != nil {
+		return err
+	}
+	written := time.Now().Unix()
+	// A replica writing the same data at once fails on the primary key
+	_, err = tx.Exec(s.rebind(`INSERT INTO user_data_history (`+userDataColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		w.Subject[:], w.Data[:], version, w.Mime, payload, written, int32(w.Source), w.Process)
+	if err != nil || !current {
+		return err
+	}
+	_, err = tx.Exec(s.rebind(`INSERT INTO user_data (`+userDataColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (subject, data) DO UPDATE SET version = excluded.version, mime = excluded.mime,
+		value = excluded.value, written = excluded.written, source = excluded.source, process = excluded.process`),
+		w.Subject[:], w.Data[:], version, w.Mime, payload, written, int32(w.Source), w.Process)
+	return err
+}
+
+const userDataColumns = `subject, data, version, mime, value, written, source, process`
+
+func scanUserData(row rowScanner) (item UserData, err error) {
+	var subject, data []byte
+	var source int32
+	err = row.Scan(&subject, &data, &item.Version, &item.Mime, &item.Value, &item.Written, &source, &item.Process)
+	copy(item.Data[:], data)
+	item.Source = pb.DataSource(source)
+	return
+}
+
+func (s *SQLStore) queryUserData(query string, args ...interface{}) (ret []UserData, err error) {
+	rows, err := s.db.Query(s.rebind(`SELECT `+userDataColumns+` FROM `+query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		item, err := scanUserData(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, item)
+	}
+	return ret, rows.Err()
+}
+
+// GetAllUserData all data of the subject, ordered by data UUID
+func (s *SQLStore) GetAllUserData(subject *[32]byte) ([]UserData, error) {
+	return s.queryUserData(`user_data WHERE subject = ? ORDER BY data`, subject[:])
+}
+
+// GetUserDataHistory all versions of the data, oldest first. Versions retrieved
+// from remote clients are never current.
+func (s *SQLStore) GetUserDataHistory(subject *[32]byte, data *[16]byte) ([]UserData, error) {
+	return s.queryUserData(`user_data_history WHERE subject = ? AND data = ? ORDER BY version`, subject[:], data[:])
+}
+
+// PruneUserDataHistory remove versions written before the time, except the
+// current ones. Returns how many were removed.
+func (s *SQLStore) PruneUserDataHistory(before time.Time) (int, error) {
+	res, err := s.exec(`DELETE FROM user_data_history WHERE written < ? AND NOT EXISTS (
+		SELECT 1 FROM user_data c WHERE c.subject = user_data_history.subject
+		AND c.data = user_data_history.data AND c.version = user_data_history.version)`, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// PruneRetrievedHistory remove versions retrieved from remote clients which no
+// running permission of the subject covers. Returns how many were removed.
+func (s *SQLStore) PruneRetrievedHistory(now time.Time) (int, error) {
+	rows, err := s.db.Query(s.rebind(`SELECT DISTINCT subject, data FROM user_data_history WHERE source = ?`),
+		int32(pb.DataSource_RETRIEVE))
+	if err != nil {
+		return 0, err
+	}
+	retrieved := make(map[[32]byte][][16]byte)
+	for rows.Next() {
+		var subject, data []byte
+		if err := rows.Scan(&subject, &data); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		var key [32]byte
+		var id [16]byte
+		copy(key[:], subject)
+		copy(id[:], data)
+		retrieved[key] = append(retrieved[key], id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// Permissions are read first, sqlite has a single connection
+	type item struct {
+		subject [32]byte
+		data    [16]byte
+	}
+	var lapsed []item
+	for subject, items := range retrieved {
+		perms, err := s.GetAllPermissions(&subject)
+		if err != nil {
+			return 0, err
+		}
+		kept := retrievedKept(perms, now)
+		for _, data := range items {
+			if !kept[DataID(data)] {
+				lapsed = append(lapsed, item{subject, data})
+			}
+		}
+	}
+	if len(lapsed) == 0 {
+		return 0, nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	removed := 0
+	for _, l := range lapsed {
+		res, err := tx.Exec(s.rebind(`DELETE FROM user_data_history WHERE subject = ? AND data = ? AND source = ?`),
+			l.subject[:], l.data[:], int32(pb.DataSource_RETRIEVE))
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		removed += int(n)
+	}
+	return removed, tx.Commit()
+}
+
+// ExtractUserData value and mime of the data, ErrDataNotFound if it is not stored
+func (s *SQLStore) ExtractUserData(subject *[32]byte, data *[16]byte) (payload []byte, mime string, err error) {
+	err = s.db.QueryRow(s.rebind(`SELECT value, mime FROM user_data WHERE subject = ? AND data = ?`), subject[:], data[:]).Scan(&payload, &mime)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", ErrDataNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if payload == nil {
+		payload = []byte{}
+	}
+	return
+}
+
+// DeleteUserData remove data and all leaves of the node with their history
+func (s *SQLStore) DeleteUserData(subject *[32]byte, data *[16]byte) error {
+	keys := deleteKeys(data)
+	args := []interface{}{subject[:]}
+	marks := make([]string, len(keys))
+	for i := range keys {
+		args = append(args, keys[i][:])
+		marks[i] = "?"
+	}
+	in := `subject = ? AND data IN (` + strings.Join(marks, ", ") + `)`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(s.rebind(`DELETE FROM user_data_history WHERE `+in), args...); err != nil {
+		return fmt.Errorf("delete history: %s", err)
+	}
+	res, err := tx.Exec(s.rebind(`DELETE FROM user_data WHERE `+in), args...)
+	if err != nil {
+		return fmt.Errorf("delete: %s", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrDataNotFound
+	}
+	return tx.Commit()
+}
+
+const permissionColumns = `subject, data, process, reason, policy, valid_from, valid_until, amount, remaining, granted`
+
+// WritePermission store granted permission, replaces the previous one for the data
+func (s *SQLStore) WritePermission(perm *pb.Permission) error {
+	perm.Remaining = perm.Amount
+	_, err := s.exec(`INSERT INTO permission (`+permissionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (subject, data) DO UPDATE SET process = excluded.process, reason = excluded.reason,
+		policy = excluded.policy, valid_from = excluded.valid_from, valid_until = excluded.valid_until,
+		amount = excluded.amount, remaining = excluded.remaining, granted = excluded.granted`,
+		perm.PublicKey, perm.Data, perm.Process, perm.Reason, perm.Policy,
+		int64(perm.From), int64(perm.Until), perm.Amount, perm.Remaining, perm.Granted)
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPermission(row rowScanner) (*pb.Permission, error) {
+	perm := &pb.Permission{}
+	var from, until int64
+	err := row.Scan(&perm.PublicKey, &perm.Data, &perm.Process, &perm.Reason, &perm.Policy,
+		&from, &until, &perm.Amount, &perm.Remaining, &perm.Granted)
+	if err != nil {
+		return nil, err
+	}
+	perm.From = uint64(from)
+	perm.Until = uint64(until)
+	return perm, nil
+}
+
+// GetAllPermissions all permissions granted by the subject, ordered by data UUID
+func (s *SQLStore) GetAllPermissions(subject *[32]byte) (ret []*pb.Permission, err error) {
+	rows, err := s.db.Query(s.rebind(`SELECT `+permissionColumns+` FROM permission WHERE subject = ? ORDER BY data`), subject[:])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		perm, err := scanPermission(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, perm)
+	}
+	return ret, rows.Err()
+}
+
+// UsePermission check permission and count one retrieval. The count is
+// decremented in the database so replicas do not hand out the same one twice.
+func (s *SQLStore) UsePermission(subject *[32]byte, data *[16]byte, now time.Time) (*pb.Permission, error) {
+	row := s.db.QueryRow(s.rebind(`SELECT `+permissionColumns+` FROM permission WHERE subject = ? AND data = ?`), subject[:], data[:])
+	perm, err := scanPermission(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrPermissionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckPermission(perm, now); err != nil {
+		return perm, err
+	}
+	if perm.GetAmount() == 0 {
+		return perm, nil
+	}
+	res, err := s.exec(`UPDATE permission SET remaining = remaining - 1 WHERE subject = ? AND data = ? AND remaining > 0`, subject[:], data[:])
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		// Used up by another replica since the select
+		perm.Remaining = 0
+		return perm, ErrPermissionExhausted
+	}
+	perm.Remaining--
+	return perm, nil
+}
+
+// WriteSession for user, zero expires never expires
+func (s *SQLStore) WriteSession(id *[16]byte, pubkey *[32]byte, expires time.Time) error {
+	var exp int64
+	if !expires.IsZero() {
+		exp = expires.Unix()
+	}
+	_, err := s.exec(`INSERT INTO session (id, pubkey, expires) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET pubkey = excluded.pubkey, expires = excluded.expires`,
+		id[:], pubkey[:], exp)
+	return err
+}
+
+// DeleteSession remove session, it is not an error if there is none
+func (s *SQLStore) DeleteSession(id *[16]byte) error {
+	_, err := s.exec(`DELETE FROM session WHERE id = ?`, id[:])
+	return err
+}
+
+// GetSession public key of the session, nil if there is none or it is expired
+func (s *SQLStore) GetSession(id *[16]byte) []byte {
+	session := &pb.UserInfo{}
+	err := s.db.QueryRow(s.rebind(`SELECT pubkey, expires FROM session WHERE id = ?`), id[:]).Scan(&session.Pubkey, &session.Expires)
+	if err != nil || sessionExpired(session, time.Now()) {
+		return nil
+	}
+	return session.Pubkey
+}
+
+// GetSessions all sessions of the user, expired ones included
+func (s *SQLStore) GetSessions(pubkey *[32]byte) (ret []*pb.UserInfo, err error) {
+	rows, err := s.db.Query(s.rebind(`SELECT id, pubkey, expires FROM session WHERE pubkey = ? ORDER BY id`), pubkey[:])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		session := &pb.UserInfo{}
+		if err := rows.Scan(&session.Uuid, &session.Pubkey, &session.Expires); err != nil {
+			return nil, err
+		}
+		ret = append(ret, session)
+	}
+	return ret, rows.Err()
+}
+
+// DeleteSessions remove all sessions of the user, returns how many were removed
+func (s *SQLStore) DeleteSessions(pubkey *[32]byte) (int, error) {
+	res, err := s.exec(`DELETE FROM session WHERE pubkey = ?`, pubkey[:])
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// PurgeExpiredSessions remove sessions expired before now, returns how many were removed
+func (s *SQLStore) PurgeExpiredSessions(now time.Time) (int, error) {
+	res, err := s.exec(`DELETE FROM session WHERE expires <> 0 AND expires <= ?`, now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+const documentColumns = `version, url, hash, submitted, ok, error`
+
+// WriteDocument store submitted document as the next version
+func (s *SQLStore) WriteDocument(doc *pb.Document) error {
+	return s.db.QueryRow(s.rebind(`INSERT INTO document (url, hash, submitted, ok, error) VALUES (?, ?, ?, ?, ?) RETURNING version`),
+		doc.Url, doc.Hash, doc.Submitted, doc.Ok, doc.Error).Scan(&doc.Version)
+}
+
+func scanDocument(row rowScanner) (*pb.Document, error) {
+	doc := &pb.Document{}
+	err := row.Scan(&doc.Version, &doc.Url, &doc.Hash, &doc.Submitted, &doc.Ok, &doc.Error)
+	return doc, err
+}
+
+// GetDocuments all submitted documents, oldest first
+func (s *SQLStore) GetDocuments() (ret []*pb.Document, err error) {
+	rows, err := s.db.Query(`SELECT ` + documentColumns + ` FROM document ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		doc, err := scanDocument(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, doc)
+	}
+	return ret, rows.Err()
+}
+
+// GetCurrentDocument latest document accepted by proxyU, nil if none
+func (s *SQLStore) GetCurrentDocument() *pb.Document {
+	doc, err := scanDocument(s.db.QueryRow(`SELECT ` + documentColumns + ` FROM document WHERE ok ORDER BY version DESC LIMIT 1`))
+	if err != nil {
+		return nil
+	}
+	return doc
+}
+
+// Stats record counts
+func (s *SQLStore) Stats(now time.Time) (stats StoreStats, err error) {
+	err = s.db.QueryRow(s.rebind(`SELECT
+		(SELECT COUNT(DISTINCT subject) FROM user_data),
+		(SELECT COUNT(*) FROM user_data),
+		(SELECT COUNT(*) FROM user_data_history),
+		(SELECT COUNT(*) FROM permission),
+		(SELECT COUNT(*) FROM session WHERE expires = 0 OR expires > ?),
+		(SELECT COUNT(*) FROM session WHERE expires <> 0 AND expires <= ?),
+		(SELECT COUNT(*) FROM document)`), now.Unix(), now.Unix()).Scan(
+		&stats.Subjects, &stats.Values, &stats.Versions, &stats.Permissions,
+		&stats.Sessions, &stats.ExpiredSessions, &stats.Documents)
+	return
+}
+
+// Close the connection pool
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"time"
+
+	"github.com/ice2heart/proxyu_client/protocol"
 
 	pb "github.com/ice2heart/proxyu_client/serialize"
 	"google.golang.org/protobuf/proto"
@@ -11,49 +18,156 @@ import (
 	bolt "go.etcd.io/bbolt"
 )
 
+// BoltStore Store in a bbolt file, one nested bucket per subject.
+// With a keyring values of user data are encrypted with a data key of the
+// subject, which is kept wrapped by the master key in the DataKey bucket.
+type BoltStore struct {
+	db   *bolt.DB
+	keys *Keyring
+}
+
 var (
-	db *bolt.DB
+	// ErrDataNotFound nothing stored for the subject and data
+	ErrDataNotFound = fmt.Errorf("data %w", protocol.ErrNotFound)
+	// ErrPermissionNotFound no permission granted for the subject and data
+	ErrPermissionNotFound = fmt.Errorf("permission %w", protocol.ErrPermissionNotFound)
+	// ErrPermissionNotYetValid permission from is in the future
+	ErrPermissionNotYetValid = errors.New("permission is not valid yet")
+	// ErrPermissionExpired permission until is in the past
+	ErrPermissionExpired = errors.New("permission is expired")
+	// ErrPermissionExhausted permission amount is used up
+	ErrPermissionExhausted = errors.New("permission is exhausted")
 )
 
-// WriteUserData if you successfully got it
-func WriteUserData(subject *[32]byte, data *[16]byte, mime *string, payload []byte) error {
-	log.Printf("Write user data %v", db.Stats())
-	err := db.Update(func(tx *bolt.Tx) error {
-		mb, err := tx.CreateBucketIfNotExists([]byte("Data"))
-		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
+// WriteUserData if you successfully got it. The value is appended to the
+// history of the data as well, the entry in Data is the current version.
+func (s *BoltStore) WriteUserData(subject *[32]byte, data *[16]byte, mime *string, payload []byte, source pb.DataSource, process []byte) error {
+	log.Printf("Write user data %v", s.db.Stats())
+	return s.WriteUserDataBatch([]UserDataWrite{{
+		Subject: *subject,
+		Data:    *data,
+		Mime:    *mime,
+		Value:   payload,
+		Source:  source,
+		Process: process,
+	}})
+}
+
+// WriteUserDataBatch write all values in one transaction
+func (s *BoltStore) WriteUserDataBatch(writes []UserDataWrite) error {
+	return s.putUserDataBatch(writes, true)
+}
+
+// AppendUserDataHistory add values to the history of the data only, in one transaction
+func (s *BoltStore) AppendUserDataHistory(writes []UserDataWrite) error {
+	return s.putUserDataBatch(writes, false)
+}
+
+func (s *BoltStore) putUserDataBatch(writes []UserDataWrite, current bool) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for i := range writes {
+			if err := s.putUserData(tx, &writes[i], current); err != nil {
+				return err
+			}
 		}
-		b, err := mb.CreateBucketIfNotExists(subject[:])
+		return nil
+	})
+}
+
+// putUserData append the value to the history, current makes it the entry in Data
+func (s *BoltStore) putUserData(tx *bolt.Tx, w *UserDataWrite, current bool) error {
+	hb, err := historyBucket(tx, w.Subject[:], w.Data[:])
+	if err != nil {
+		return err
+	}
+	seq, err := hb.NextSequence()
+	if err != nil {
+		return fmt.Errorf("sequence: %s", err)
+	}
+	m := &pb.UserData{
+		Mime:    w.Mime,
+		Value:   w.Value,
+		Version: uint32(seq),
+		Written: time.Now().Unix(),
+		Source:  w.Source,
+		Process: w.Process,
+	}
+	if s.keys != nil {
+		key, err := s.writeSubjectKey(tx, w.Subject[:])
 		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
+			return err
 		}
-		m := &pb.UserData{
-			Mime:  *mime,
-			Value: payload,
+		if err := key.sealValue(m, w.Subject[:], w.Data[:]); err != nil {
+			return err
 		}
-		mBytes, err := proto.Marshal(m)
-		if err != nil {
-			return fmt.Errorf("marshal error: %s", err)
-		}
-		err = b.Put(data[:], mBytes)
-		return err
-	})
+	}
+	mBytes, err := proto.Marshal(m)
 	if err != nil {
-		// fmt.Fprintf(os.Stderr, "WriteUserData error: %v", err)
+		return fmt.Errorf("marshal error: %s", err)
+	}
+	if err := hb.Put(versionKey(m.Version), mBytes); err != nil {
 		return err
 	}
-	return nil
+	if !current {
+		return nil
+	}
+	mb, err := tx.CreateBucketIfNotExists([]byte("Data"))
+	if err != nil {
+		return fmt.Errorf("create bucket: %s", err)
+	}
+	b, err := mb.CreateBucketIfNotExists(w.Subject[:])
+	if err != nil {
+		return fmt.Errorf("create bucket: %s", err)
+	}
+	return b.Put(w.Data[:], mBytes)
+}
+
+// historyBucket History/subject/data, one entry per version
+func historyBucket(tx *bolt.Tx, subject, data []byte) (*bolt.Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists([]byte("History"))
+	if err != nil {
+		return nil, fmt.Errorf("create bucket: %s", err)
+	}
+	for _, name := range [][]byte{subject, data} {
+		if b, err = b.CreateBucketIfNotExists(name); err != nil {
+			return nil, fmt.Errorf("create bucket: %s", err)
+		}
+	}
+	return b, nil
+}
+
+func versionKey(version uint32) []byte {
+	var key [4]byte
+	binary.BigEndian.PutUint32(key[:], version)
+	return key[:]
 }
 
 type UserData struct {
 	Data  [16]byte
 	Mime  string
 	Value []byte
+	// Version in the history, 0 if the value was written before versioning
+	Version uint32
+	// Written Unix UTC timestamp
+	Written int64
+	Source  pb.DataSource
+	Process []byte
+}
+
+func userDataOf(data []byte, m *pb.UserData) (item UserData) {
+	copy(item.Data[:], data)
+	item.Mime = m.GetMime()
+	item.Value = m.GetValue()
+	item.Version = m.GetVersion()
+	item.Written = m.GetWritten()
+	item.Source = m.GetSource()
+	item.Process = m.GetProcess()
+	return
 }
 
 // GetAllUserData extract all data for user
-func GetAllUserData(subject *[32]byte) (ret []UserData, err error) {
-	err = db.View(func(tx *bolt.Tx) error {
+func (s *BoltStore) GetAllUserData(subject *[32]byte) (ret []UserData, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
 
 		b := tx.Bucket([]byte("Data"))
 		if b == nil {
@@ -63,52 +177,274 @@ func GetAllUserData(subject *[32]byte) (ret []UserData, err error) {
 		if ub == nil {
 			return nil
 		}
-		ub.ForEach(func(k, v []byte) error {
+		key := s.loadSubjectKey(tx, subject[:])
+		return ub.ForEach(func(k, v []byte) error {
 
-			var item UserData
-			copy(item.Data[:], k)
 			userData := &pb.UserData{}
 			proto.Unmarshal(v, userData)
-			item.Mime = userData.Mime
+			if err := key.openValue(userData, subject[:], k); err != nil {
+				return err
+			}
 			// fmt.Printf("key=%v, value=%v mime=%s\n", k, userData.Value, userData.Mime)
-			// copy(item.Value, userData.Value)
-			item.Value = userData.Value
-			ret = append(ret, item)
+			ret = append(ret, userDataOf(k, userData))
 			return nil
 		})
+	})
+	return
+}
+
+// ExtractUserData userdata + mimetype of data, ErrDataNotFound if it is not stored
+func (s *BoltStore) ExtractUserData(subject *[32]byte, data *[16]byte) (payload []byte, mime string, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		pbd := tx.Bucket([]byte("Data"))
+		if pbd == nil {
+			return ErrDataNotFound
+		}
+		sb := pbd.Bucket(subject[:])
+		if sb == nil {
+			return ErrDataNotFound
+		}
+		v := sb.Get(data[:])
+		if v == nil {
+			return ErrDataNotFound
+		}
+		userData := &pb.UserData{}
+		if err := proto.Unmarshal(v, userData); err != nil {
+			return fmt.Errorf("unmarshal error: %s", err)
+		}
+		if err := s.loadSubjectKey(tx, subject[:]).openValue(userData, subject[:], data[:]); err != nil {
+			return fmt.Errorf("read user data %x: %w", data[:], err)
+		}
+		payload = make([]byte, len(userData.GetValue()))
+		copy(payload, userData.GetValue())
+		mime = userData.GetMime()
 		return nil
 	})
 	return
 }
 
-// ExtractUserData userdata + mimetype of data
-func ExtractUserData(subject *[32]byte, data *[16]byte) (payload []byte, mime string) {
-	db.View(func(tx *bolt.Tx) error {
+// DeleteUserData remove data and all children of the node
+func (s *BoltStore) DeleteUserData(subject *[32]byte, data *[16]byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
 		pbd := tx.Bucket([]byte("Data"))
 		if pbd == nil {
-			return nil
+			return ErrDataNotFound
 		}
 		sb := pbd.Bucket(subject[:])
 		if sb == nil {
+			return ErrDataNotFound
+		}
+		// History of deleted data is removed as well
+		var hb *bolt.Bucket
+		if b := tx.Bucket([]byte("History")); b != nil {
+			hb = b.Bucket(subject[:])
+		}
+		found := false
+		for _, k := range deleteKeys(data) {
+			if hb != nil && hb.Bucket(k[:]) != nil {
+				if err := hb.DeleteBucket(k[:]); err != nil {
+					return fmt.Errorf("delete history: %s", err)
+				}
+			}
+			if sb.Get(k[:]) == nil {
+				continue
+			}
+			found = true
+			if err := sb.Delete(k[:]); err != nil {
+				return fmt.Errorf("delete: %s", err)
+			}
+		}
+		if !found {
+			return ErrDataNotFound
+		}
+		return nil
+	})
+}
+
+// deleteKeys the node and all its leaves, only the node if it is not in the didgraph
+func deleteKeys(data *[16]byte) [][16]byte {
+	keys := [][16]byte{*data}
+	if leaves, err := GetDAGLeaves(data); err == nil {
+		keys = append(keys, leaves...)
+	}
+	return keys
+}
+
+// WritePermission store granted permission, replaces the previous one for the data
+func (s *BoltStore) WritePermission(perm *pb.Permission) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putPermission(tx, perm)
+	})
+}
+
+func putPermission(tx *bolt.Tx, perm *pb.Permission) error {
+	mb, err := tx.CreateBucketIfNotExists([]byte("Permission"))
+	if err != nil {
+		return fmt.Errorf("create bucket: %s", err)
+	}
+	b, err := mb.CreateBucketIfNotExists(perm.PublicKey)
+	if err != nil {
+		return fmt.Errorf("create bucket: %s", err)
+	}
+	perm.Remaining = perm.Amount
+	mBytes, err := proto.Marshal(perm)
+	if err != nil {
+		return fmt.Errorf("marshal error: %s", err)
+	}
+	return b.Put(perm.Data, mBytes)
+}
+
+// legacyPermissionMime user data written as marker of a granted permission
+// before permissions had their own bucket
+const legacyPermissionMime = "Empty"
+
+// MigrateLegacyPermissions replace the permission markers of older versions
+// with permissions of their profile, valid from now on. Markers of data which
+// has a permission already are dropped. Returns how many were migrated.
+func (s *BoltStore) MigrateLegacyPermissions(process []byte, profiles PermissionProfiles, now time.Time) (migrated int, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		db := tx.Bucket([]byte("Data"))
+		if db == nil {
 			return nil
 		}
-		v := sb.Get(data[:])
-		if v != nil {
-			userData := &pb.UserData{}
-			proto.Unmarshal(v, userData)
+		var markers [][2][]byte
+		err := db.ForEach(func(subject, _ []byte) error {
+			sb := db.Bucket(subject)
+			if sb == nil {
+				return nil
+			}
+			return sb.ForEach(func(data, v []byte) error {
+				m := &pb.UserData{}
+				if proto.Unmarshal(v, m) == nil && m.GetMime() == legacyPermissionMime {
+					markers = append(markers, [2][]byte{append([]byte(nil), subject...), append([]byte(nil), data...)})
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		// Buckets must not be changed while iterating
+		for _, marker := range markers {
+			subject, data := marker[0], marker[1]
+			if err := db.Bucket(subject).Delete(data); err != nil {
+				return err
+			}
+			if hb := tx.Bucket([]byte("History")); hb != nil && hb.Bucket(subject) != nil && hb.Bucket(subject).Bucket(data) != nil {
+				if err := hb.Bucket(subject).DeleteBucket(data); err != nil {
+					return err
+				}
+			}
+			if perms := tx.Bucket([]byte("Permission")); perms != nil && perms.Bucket(subject) != nil && perms.Bucket(subject).Get(data) != nil {
+				continue
+			}
+			var dataUUID [16]byte
+			copy(dataUUID[:], data)
+			params, err := profiles.Get(&dataUUID).Params(nil, now)
+			if err != nil {
+				return err
+			}
+			err = putPermission(tx, &pb.Permission{
+				PublicKey: subject,
+				Data:      data,
+				Process:   process,
+				Reason:    params.Reason,
+				From:      params.From,
+				Until:     params.Until,
+				Amount:    params.Amount,
+				Granted:   now.Unix(),
+			})
+			if err != nil {
+				return err
+			}
+			migrated++
+		}
+		return nil
+	})
+	return
+}
 
-			payload = make([]byte, len(userData.GetValue()))
-			copy(payload, userData.GetValue())
-			mime = userData.GetMime()
+// GetAllPermissions extract all permissions granted by user
+func (s *BoltStore) GetAllPermissions(subject *[32]byte) (ret []*pb.Permission, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Permission"))
+		if b == nil {
+			return nil
 		}
+		ub := b.Bucket(subject[:])
+		if ub == nil {
+			return nil
+		}
+		ret, err = readPermissions(ub)
+		return err
+	})
+	return
+}
+
+// readPermissions all permissions in the bucket of a subject
+func readPermissions(b *bolt.Bucket) (ret []*pb.Permission, err error) {
+	err = b.ForEach(func(k, v []byte) error {
+		perm := &pb.Permission{}
+		if err := proto.Unmarshal(v, perm); err != nil {
+			return fmt.Errorf("unmarshal error: %s", err)
+		}
+		ret = append(ret, perm)
 		return nil
 	})
 	return
 }
 
-//WriteSession for user
-func WriteSession(id *[16]byte, pubkey *[32]byte) error {
-	err := db.Update(func(tx *bolt.Tx) error {
+// CheckPermission error if permission can not be used at the moment
+func CheckPermission(perm *pb.Permission, now time.Time) error {
+	switch {
+	case uint64(now.Unix()) < perm.GetFrom():
+		return ErrPermissionNotYetValid
+	case uint64(now.Unix()) > perm.GetUntil():
+		return ErrPermissionExpired
+	case perm.GetAmount() > 0 && perm.GetRemaining() == 0:
+		return ErrPermissionExhausted
+	}
+	return nil
+}
+
+// UsePermission check permission and count one retrieval
+func (s *BoltStore) UsePermission(subject *[32]byte, data *[16]byte, now time.Time) (perm *pb.Permission, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Permission"))
+		if b == nil {
+			return ErrPermissionNotFound
+		}
+		ub := b.Bucket(subject[:])
+		if ub == nil {
+			return ErrPermissionNotFound
+		}
+		v := ub.Get(data[:])
+		if v == nil {
+			return ErrPermissionNotFound
+		}
+		perm = &pb.Permission{}
+		if err := proto.Unmarshal(v, perm); err != nil {
+			return fmt.Errorf("unmarshal error: %s", err)
+		}
+		if err := CheckPermission(perm, now); err != nil {
+			return err
+		}
+		if perm.GetAmount() == 0 {
+			return nil
+		}
+		perm.Remaining--
+		mBytes, err := proto.Marshal(perm)
+		if err != nil {
+			return fmt.Errorf("marshal error: %s", err)
+		}
+		return ub.Put(data[:], mBytes)
+	})
+	return
+}
+
+//WriteSession for user, zero expires never expires
+func (s *BoltStore) WriteSession(id *[16]byte, pubkey *[32]byte, expires time.Time) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
 		mb, err := tx.CreateBucketIfNotExists([]byte("Session"))
 		if err != nil {
 			return fmt.Errorf("create bucket: %s", err)
@@ -117,6 +453,9 @@ func WriteSession(id *[16]byte, pubkey *[32]byte) error {
 			Uuid:   id[:],
 			Pubkey: pubkey[:],
 		}
+		if !expires.IsZero() {
+			m.Expires = expires.Unix()
+		}
 		mBytes, err := proto.Marshal(m)
 		if err != nil {
 			return fmt.Errorf("marshal error: %s", err)
@@ -131,9 +470,20 @@ func WriteSession(id *[16]byte, pubkey *[32]byte) error {
 	return nil
 }
 
+// DeleteSession remove session, it is not an error if there is none
+func (s *BoltStore) DeleteSession(id *[16]byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Session"))
+		if b == nil {
+			return nil
+		}
+		return b.Delete(id[:])
+	})
+}
+
 //GetSession for user
-func GetSession(id *[16]byte) (pubkey []byte) {
-	db.View(func(tx *bolt.Tx) error {
+func (s *BoltStore) GetSession(id *[16]byte) (pubkey []byte) {
+	s.db.View(func(tx *bolt.Tx) error {
 		pbd := tx.Bucket([]byte("Session"))
 		if pbd == nil {
 			return nil
@@ -144,6 +494,9 @@ func GetSession(id *[16]byte) (pubkey []byte) {
 		}
 		userSession := &pb.UserInfo{}
 		proto.Unmarshal(v, userSession)
+		if sessionExpired(userSession, time.Now()) {
+			return nil
+		}
 
 		pubkey = make([]byte, len(userSession.GetPubkey()))
 		copy(pubkey, userSession.GetPubkey())
@@ -152,14 +505,617 @@ func GetSession(id *[16]byte) (pubkey []byte) {
 	return
 }
 
-//OpenDB init db process
-func OpenDB(fileName *string, intSig chan os.Signal) {
-	var err error
-	db, err = bolt.Open(*fileName, 0600, nil)
+// GetSessions all sessions of the user, expired ones included
+func (s *BoltStore) GetSessions(pubkey *[32]byte) (ret []*pb.UserInfo, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Session"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			session := &pb.UserInfo{}
+			if err := proto.Unmarshal(v, session); err != nil {
+				return fmt.Errorf("unmarshal error: %s", err)
+			}
+			if bytes.Equal(session.GetPubkey(), pubkey[:]) {
+				ret = append(ret, session)
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// DeleteSessions remove all sessions of the user, returns how many were removed
+func (s *BoltStore) DeleteSessions(pubkey *[32]byte) (removed int, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Session"))
+		if b == nil {
+			return nil
+		}
+		return deleteSessionsIf(b, func(s *pb.UserInfo) bool {
+			if bytes.Equal(s.GetPubkey(), pubkey[:]) {
+				removed++
+				return true
+			}
+			return false
+		})
+	})
+	return
+}
+
+// PurgeExpiredSessions remove sessions expired before now, returns how many were removed
+func (s *BoltStore) PurgeExpiredSessions(now time.Time) (removed int, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Session"))
+		if b == nil {
+			return nil
+		}
+		return deleteSessionsIf(b, func(s *pb.UserInfo) bool {
+			if sessionExpired(s, now) {
+				removed++
+				return true
+			}
+			return false
+		})
+	})
+	return
+}
+
+func deleteSessionsIf(b *bolt.Bucket, match func(*pb.UserInfo) bool) error {
+	// Deleting while iterating with ForEach is not allowed
+	var keys [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		s := &pb.UserInfo{}
+		if err := proto.Unmarshal(v, s); err != nil {
+			return fmt.Errorf("unmarshal error: %s", err)
+		}
+		if match(s) {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sessionExpired(s *pb.UserInfo, now time.Time) bool {
+	return s.GetExpires() != 0 && now.Unix() >= s.GetExpires()
+}
+
+// NewBoltStore open or create the bbolt file, keys nil stores user data unencrypted
+func NewBoltStore(fileName string, keys *Keyring) (*BoltStore, error) {
+	db, err := openBolt(fileName, 0600, false)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db, keys: keys}, nil
+}
+
+// openBolt open the file, the lock of another process is reported after a second
+func openBolt(fileName string, mode os.FileMode, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(fileName, mode, &bolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s is in use by another process", fileName)
+	}
+	return db, err
+}
+
+// subjectKey data key of a subject, err is reported once a record needs the key
+type subjectKey struct {
+	dk   *pb.DataKey
+	aead cipher.AEAD
+	err  error
+}
+
+// loadSubjectKey unwrapped data key of the subject, dk is nil if there is none
+func (s *BoltStore) loadSubjectKey(tx *bolt.Tx, subject []byte) (key subjectKey) {
+	b := tx.Bucket([]byte("DataKey"))
+	if b == nil {
+		return
+	}
+	v := b.Get(subject)
+	if v == nil {
+		return
+	}
+	key.dk = &pb.DataKey{}
+	if err := proto.Unmarshal(v, key.dk); err != nil {
+		key.err = fmt.Errorf("unmarshal error: %s", err)
+		return
+	}
+	if s.keys == nil {
+		key.err = fmt.Errorf("%w: no master key is loaded", ErrUnknownKey)
+		return
+	}
+	key.aead, key.err = s.keys.unwrap(subject, key.dk)
+	return
+}
+
+// writeSubjectKey data key of the subject, a new one is stored if there is none
+func (s *BoltStore) writeSubjectKey(tx *bolt.Tx, subject []byte) (subjectKey, error) {
+	key := s.loadSubjectKey(tx, subject)
+	if key.dk != nil {
+		return key, key.err
+	}
+	return s.putSubjectKey(tx, subject)
+}
+
+// putSubjectKey store new data key of the subject, replaces the previous one
+func (s *BoltStore) putSubjectKey(tx *bolt.Tx, subject []byte) (key subjectKey, err error) {
+	b, err := tx.CreateBucketIfNotExists([]byte("DataKey"))
+	if err != nil {
+		return key, fmt.Errorf("create bucket: %s", err)
+	}
+	key.dk, key.aead, err = s.keys.newDataKey(subject)
+	if err != nil {
+		return key, err
+	}
+	mBytes, err := proto.Marshal(key.dk)
+	if err != nil {
+		return key, fmt.Errorf("marshal error: %s", err)
+	}
+	return key, b.Put(subject, mBytes)
+}
+
+// userDataAAD binds a ciphertext to the subject and data it is stored for
+func userDataAAD(subject, data []byte) []byte {
+	return append(append([]byte(nil), subject...), data...)
+}
+
+// sealValue encrypt value of the record in place
+func (k subjectKey) sealValue(m *pb.UserData, subject, data []byte) (err error) {
+	m.Value, err = seal(k.aead, m.Value, userDataAAD(subject, data))
+	m.KeyId = k.dk.GetId()
+	return
+}
+
+// openValue decrypt value of the record in place, plain records are left as they are
+func (k subjectKey) openValue(m *pb.UserData, subject, data []byte) (err error) {
+	if m.GetKeyId() == "" {
+		return nil
+	}
+	if k.err != nil {
+		return k.err
+	}
+	if k.dk == nil || k.dk.GetId() != m.GetKeyId() {
+		return fmt.Errorf("%w: data key %s", ErrUnknownKey, m.GetKeyId())
+	}
+	m.Value, err = open(k.aead, m.GetValue(), userDataAAD(subject, data))
+	m.KeyId = ""
+	return
+}
+
+// RotateKeys give every subject a new data key wrapped by the current master
+// key and re-encrypt all values with it, unencrypted values included
+func (s *BoltStore) RotateKeys() (subjects, values int, err error) {
+	if s.keys == nil {
+		return 0, 0, fmt.Errorf("%w: no master key is loaded", ErrUnknownKey)
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		// Buckets must not be changed while iterating. Subjects with
+		// retrieved values only have a history but no current values.
+		var names [][]byte
+		seen := make(map[string]bool)
+		for _, name := range []string{"Data", "History"} {
+			if b := tx.Bucket([]byte(name)); b != nil {
+				b.ForEach(func(k, v []byte) error {
+					if v == nil && !seen[string(k)] {
+						seen[string(k)] = true
+						names = append(names, append([]byte(nil), k...))
+					}
+					return nil
+				})
+			}
+		}
+		mb := tx.Bucket([]byte("Data"))
+		for _, subject := range names {
+			var b *bolt.Bucket
+			if mb != nil {
+				b = mb.Bucket(subject)
+			}
+			n, err := s.rotateSubject(tx, b, subject)
+			if err != nil {
+				return fmt.Errorf("subject %x: %w", subject, err)
+			}
+			subjects++
+			values += n
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return
+}
+
+// rotateSubject re-encrypt current values and history of the subject with a new
+// key, b is nil if the subject has no current values
+func (s *BoltStore) rotateSubject(tx *bolt.Tx, b *bolt.Bucket, subject []byte) (int, error) {
+	old := s.loadSubjectKey(tx, subject)
+	key, err := s.putSubjectKey(tx, subject)
+	if err != nil {
+		return 0, err
+	}
+	var values int
+	if b != nil {
+		if values, err = resealBucket(b, subject, nil, old, key); err != nil {
+			return 0, err
+		}
+	}
+	var hb *bolt.Bucket
+	if b := tx.Bucket([]byte("History")); b != nil {
+		hb = b.Bucket(subject)
+	}
+	if hb == nil {
+		return values, nil
+	}
+	var names [][]byte
+	hb.ForEach(func(k, v []byte) error {
+		if v == nil {
+			names = append(names, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	for _, data := range names {
+		n, err := resealBucket(hb.Bucket(data), subject, data, old, key)
+		if err != nil {
+			return 0, err
+		}
+		values += n
+	}
+	return values, nil
+}
+
+// resealBucket decrypt all records of the bucket with old and encrypt them with
+// key. data is the data UUID of the records, nil if it is the key of the record.
+func resealBucket(b *bolt.Bucket, subject, data []byte, old, key subjectKey) (int, error) {
+	records := make(map[string]*pb.UserData)
+	err := b.ForEach(func(k, v []byte) error {
+		m := &pb.UserData{}
+		if err := proto.Unmarshal(v, m); err != nil {
+			return fmt.Errorf("unmarshal error: %s", err)
+		}
+		if err := old.openValue(m, subject, dataOr(data, k)); err != nil {
+			return err
+		}
+		records[string(k)] = m
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for k, m := range records {
+		if err := key.sealValue(m, subject, dataOr(data, []byte(k))); err != nil {
+			return 0, err
+		}
+		mBytes, err := proto.Marshal(m)
+		if err != nil {
+			return 0, fmt.Errorf("marshal error: %s", err)
+		}
+		if err := b.Put([]byte(k), mBytes); err != nil {
+			return 0, err
+		}
+	}
+	return len(records), nil
+}
+
+func dataOr(data, key []byte) []byte {
+	if data != nil {
+		return data
+	}
+	return key
+}
+
+// GetUserDataHistory all versions of the data, oldest first. Versions retrieved
+// from remote clients are never current.
+func (s *BoltStore) GetUserDataHistory(subject *[32]byte, data *[16]byte) (ret []UserData, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("History"))
+		if b == nil {
+			return nil
+		}
+		if b = b.Bucket(subject[:]); b == nil {
+			return nil
+		}
+		if b = b.Bucket(data[:]); b == nil {
+			return nil
+		}
+		key := s.loadSubjectKey(tx, subject[:])
+		return b.ForEach(func(k, v []byte) error {
+			m := &pb.UserData{}
+			if err := proto.Unmarshal(v, m); err != nil {
+				return fmt.Errorf("unmarshal error: %s", err)
+			}
+			if err := key.openValue(m, subject[:], data[:]); err != nil {
+				return err
+			}
+			ret = append(ret, userDataOf(data[:], m))
+			return nil
+		})
+	})
+	return
+}
+
+// PruneUserDataHistory remove versions written before the time, except the
+// current ones. Returns how many were removed.
+func (s *BoltStore) PruneUserDataHistory(before time.Time) (removed int, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte("History"))
+		if hb == nil {
+			return nil
+		}
+		db := tx.Bucket([]byte("Data"))
+		return hb.ForEach(func(subject, v []byte) error {
+			sb := hb.Bucket(subject)
+			if sb == nil {
+				return nil
+			}
+			var current *bolt.Bucket
+			if db != nil {
+				current = db.Bucket(subject)
+			}
+			return sb.ForEach(func(data, v []byte) error {
+				b := sb.Bucket(data)
+				if b == nil {
+					return nil
+				}
+				var currentVersion uint32
+				if current != nil {
+					m := &pb.UserData{}
+					if v := current.Get(data); v != nil && proto.Unmarshal(v, m) == nil {
+						currentVersion = m.GetVersion()
+					}
+				}
+				var keys [][]byte
+				err := b.ForEach(func(k, v []byte) error {
+					m := &pb.UserData{}
+					if err := proto.Unmarshal(v, m); err != nil {
+						return fmt.Errorf("unmarshal error: %s", err)
+					}
+					if m.GetVersion() != currentVersion && m.GetWritten() < before.Unix() {
+						keys = append(keys, append([]byte(nil), k...))
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				for _, k := range keys {
+					if err := b.Delete(k); err != nil {
+						return err
+					}
+				}
+				removed += len(keys)
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// PruneRetrievedHistory remove versions retrieved from remote clients which no
+// running permission of the subject covers. Returns how many were removed.
+func (s *BoltStore) PruneRetrievedHistory(now time.Time) (removed int, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte("History"))
+		if hb == nil {
+			return nil
+		}
+		permissions := tx.Bucket([]byte("Permission"))
+		return hb.ForEach(func(subject, v []byte) error {
+			sb := hb.Bucket(subject)
+			if sb == nil {
+				return nil
+			}
+			var perms []*pb.Permission
+			if permissions != nil && permissions.Bucket(subject) != nil {
+				var err error
+				if perms, err = readPermissions(permissions.Bucket(subject)); err != nil {
+					return err
+				}
+			}
+			kept := retrievedKept(perms, now)
+			return sb.ForEach(func(data, v []byte) error {
+				b := sb.Bucket(data)
+				if b == nil || kept[dataIDOf(data)] {
+					return nil
+				}
+				var keys [][]byte
+				err := b.ForEach(func(k, v []byte) error {
+					m := &pb.UserData{}
+					if err := proto.Unmarshal(v, m); err != nil {
+						return fmt.Errorf("unmarshal error: %s", err)
+					}
+					if m.GetSource() == pb.DataSource_RETRIEVE {
+						keys = append(keys, append([]byte(nil), k...))
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				for _, k := range keys {
+					if err := b.Delete(k); err != nil {
+						return err
+					}
+				}
+				removed += len(keys)
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// Close the bbolt file
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// WriteDocument store submitted document as the next version
+func (s *BoltStore) WriteDocument(doc *pb.Document) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("Document"))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return fmt.Errorf("sequence: %s", err)
+		}
+		doc.Version = uint32(seq)
+		mBytes, err := proto.Marshal(doc)
+		if err != nil {
+			return fmt.Errorf("marshal error: %s", err)
+		}
+		var key [4]byte
+		binary.BigEndian.PutUint32(key[:], doc.Version)
+		return b.Put(key[:], mBytes)
+	})
+}
+
+// GetDocuments all submitted documents, oldest first
+func (s *BoltStore) GetDocuments() (ret []*pb.Document, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Document"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			doc := &pb.Document{}
+			if err := proto.Unmarshal(v, doc); err != nil {
+				return fmt.Errorf("unmarshal error: %s", err)
+			}
+			ret = append(ret, doc)
+			return nil
+		})
+	})
+	return
+}
+
+// GetCurrentDocument latest document accepted by proxyU, nil if none
+func (s *BoltStore) GetCurrentDocument() (doc *pb.Document) {
+	s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Document"))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			d := &pb.Document{}
+			if proto.Unmarshal(v, d) == nil && d.GetOk() {
+				doc = d
+				return nil
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Stats record counts
+func (s *BoltStore) Stats(now time.Time) (stats StoreStats, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte("Data")); b != nil {
+			b.ForEach(func(subject, _ []byte) error {
+				if n := bucketKeys(b.Bucket(subject)); n > 0 {
+					stats.Subjects++
+					stats.Values += n
+				}
+				return nil
+			})
+		}
+		if b := tx.Bucket([]byte("History")); b != nil {
+			b.ForEach(func(subject, _ []byte) error {
+				sb := b.Bucket(subject)
+				return sb.ForEach(func(data, _ []byte) error {
+					stats.Versions += bucketKeys(sb.Bucket(data))
+					return nil
+				})
+			})
+		}
+		if b := tx.Bucket([]byte("Permission")); b != nil {
+			b.ForEach(func(subject, _ []byte) error {
+				stats.Permissions += bucketKeys(b.Bucket(subject))
+				return nil
+			})
+		}
+		if b := tx.Bucket([]byte("Session")); b != nil {
+			err := b.ForEach(func(k, v []byte) error {
+				session := &pb.UserInfo{}
+				if err := proto.Unmarshal(v, session); err != nil {
+					return fmt.Errorf("unmarshal error: %s", err)
+				}
+				if sessionExpired(session, now) {
+					stats.ExpiredSessions++
+				} else {
+					stats.Sessions++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		stats.Documents = bucketKeys(tx.Bucket([]byte("Document")))
+		stats.DataKeys = bucketKeys(tx.Bucket([]byte("DataKey")))
+		return nil
+	})
+	return
+}
+
+// bucketKeys number of keys of the bucket, 0 for nil
+func bucketKeys(b *bolt.Bucket) (n int) {
+	if b == nil {
+		return 0
+	}
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	return
+}
+
+// CompactBoltFile rewrite the file without its free pages, so values which
+// were deleted or re-encrypted are gone. It fails while the server has the
+// file open. Returns the sizes of the file before and after.
+func CompactBoltFile(fileName string) (before, after int64, err error) {
+	src, err := openBolt(fileName, 0600, true)
 	if err != nil {
-		log.Fatal(err)
+		return 0, 0, err
+	}
+	defer src.Close()
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return 0, 0, err
+	}
+	tmpName := fileName + ".compact"
+	dst, err := openBolt(tmpName, info.Mode(), false)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = bolt.Compact(dst, src, 64<<20)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return 0, 0, fmt.Errorf("compact: %s", err)
+	}
+	compacted, err := os.Stat(tmpName)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := os.Rename(tmpName, fileName); err != nil {
+		os.Remove(tmpName)
+		return 0, 0, err
 	}
-	log.Println("DB is open")
-	defer db.Close()
-	<-intSig
+	return info.Size(), compacted.Size(), nil
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	pb "github.com/ice2heart/proxyu_client/serialize"
+	"github.com/sirupsen/logrus"
+)
+
+// Store persistence of user data, permissions, sessions and documents.
+// Errors of missing records are ErrDataNotFound and ErrPermissionNotFound.
+type Store interface {
+	// WriteUserData replace value of the data, the value is appended to its history
+	WriteUserData(subject *[32]byte, data *[16]byte, mime *string, payload []byte, source pb.DataSource, process []byte) error
+	// WriteUserDataBatch write all values in one transaction
+	WriteUserDataBatch(writes []UserDataWrite) error
+	// GetAllUserData all data of the subject, ordered by data UUID
+	GetAllUserData(subject *[32]byte) ([]UserData, error)
+	// ExtractUserData value and mime of the data, ErrDataNotFound if it is not stored
+	ExtractUserData(subject *[32]byte, data *[16]byte) (payload []byte, mime string, err error)
+	// DeleteUserData remove data and all leaves of the node with their history.
+	// It erases the subject's data, no version is kept.
+	DeleteUserData(subject *[32]byte, data *[16]byte) error
+	// GetUserDataHistory all versions of the data, oldest first. Versions retrieved
+	// from remote clients are never current.
+	GetUserDataHistory(subject *[32]byte, data *[16]byte) ([]UserData, error)
+	// AppendUserDataHistory add values to the history of the data only, the
+	// current values are left alone. Retrieved values are kept this way.
+	AppendUserDataHistory(writes []UserDataWrite) error
+	// PruneUserDataHistory remove versions written before the time, except the
+	// current ones. Returns how many were removed.
+	PruneUserDataHistory(before time.Time) (int, error)
+	// PruneRetrievedHistory remove versions retrieved from remote clients which
+	// no running permission of the subject covers. Returns how many were removed.
+	PruneRetrievedHistory(now time.Time) (int, error)
+
+	// WritePermission store granted permission, replaces the previous one for the data
+	WritePermission(perm *pb.Permission) error
+	// GetAllPermissions all permissions granted by the subject
+	GetAllPermissions(subject *[32]byte) ([]*pb.Permission, error)
+	// UsePermission check permission and count one retrieval
+	UsePermission(subject *[32]byte, data *[16]byte, now time.Time) (*pb.Permission, error)
+
+	// WriteSession for user, zero expires never expires
+	WriteSession(id *[16]byte, pubkey *[32]byte, expires time.Time) error
+	// DeleteSession remove session, it is not an error if there is none
+	DeleteSession(id *[16]byte) error
+	// GetSession public key of the session, nil if there is none or it is expired
+	GetSession(id *[16]byte) []byte
+	// GetSessions all sessions of the user, expired ones included
+	GetSessions(pubkey *[32]byte) ([]*pb.UserInfo, error)
+	// DeleteSessions remove all sessions of the user, returns how many were removed
+	DeleteSessions(pubkey *[32]byte) (int, error)
+	// PurgeExpiredSessions remove sessions expired before now, returns how many were removed
+	PurgeExpiredSessions(now time.Time) (int, error)
+
+	// WriteDocument store submitted document as the next version
+	WriteDocument(doc *pb.Document) error
+	// GetDocuments all submitted documents, oldest first
+	GetDocuments() ([]*pb.Document, error)
+	// GetCurrentDocument latest document accepted by proxyU, nil if none
+	GetCurrentDocument() *pb.Document
+
+	// Stats record counts, sessions expired before now are counted apart
+	Stats(now time.Time) (StoreStats, error)
+	Close() error
+}
+
+// StoreStats record counts of a store, reported by `db inspect`
+type StoreStats struct {
+	Subjects        int
+	Values          int
+	Versions        int
+	Permissions     int
+	Sessions        int
+	ExpiredSessions int
+	Documents       int
+	// DataKeys encryption keys of subjects, bolt only
+	DataKeys int
+}
+
+// UserDataWrite one value of WriteUserDataBatch or AppendUserDataHistory
+type UserDataWrite struct {
+	Subject [32]byte
+	Data    [16]byte
+	Mime    string
+	Value   []byte
+	Source  pb.DataSource
+	Process []byte
+}
+
+var (
+	_ Store = (*BoltStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+	_ Store = (*SQLStore)(nil)
+)
+
+// openStore backend selected by the storage flags
+func openStore() (Store, error) {
+	switch *storageBackend {
+	case "bolt":
+		keys, err := LoadKeyring(*masterKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("master key: %w", err)
+		}
+		if keys == nil {
+			if err := checkPlaintext(fmt.Sprintf("-master-key and %s are not set", masterKeyEnv)); err != nil {
+				return nil, err
+			}
+		}
+		return NewBoltStore(*userDataDB, keys)
+	case "postgres":
+		if err := checkPlaintext("the postgres storage does not encrypt user data"); err != nil {
+			return nil, err
+		}
+		return NewSQLStore("postgres", *storageDSN)
+	case "sqlite":
+		if *storageDSN == "" {
+			return nil, errors.New("sqlite storage needs -storage-dsn, e.g. file:userdata.sqlite")
+		}
+		if err := checkPlaintext("the sqlite storage does not encrypt user data"); err != nil {
+			return nil, err
+		}
+		return NewSQLStore("sqlite3", *storageDSN)
+	case "memory":
+		return NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", *storageBackend)
+}
+
+// checkPlaintext error why user data would be stored unencrypted, unless
+// -allow-plaintext is set
+func checkPlaintext(reason string) error {
+	if !*allowPlaintext {
+		return fmt.Errorf("%s, set -allow-plaintext to store user data unencrypted", reason)
+	}
+	logrus.Warnf("%s, storing user data unencrypted as -allow-plaintext is set", reason)
+	return nil
+}
+
+// dbInspectCmd `db inspect` record counts of the storage
+func dbInspectCmd(args []string) {
+	parseArgs(newFlagSet("db inspect", ""), args, 0, 0)
+	// Opening would create an empty file
+	if _, err := os.Stat(*userDataDB); *storageBackend == "bolt" && err != nil {
+		logrus.Fatal(err)
+	}
+	store, err := openStore()
+	if err != nil {
+		logrus.Fatalf("storage: %v", err)
+	}
+	defer store.Close()
+	stats, err := store.Stats(time.Now())
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	fmt.Printf("storage: %s\n", *storageBackend)
+	if *storageBackend == "bolt" {
+		if info, err := os.Stat(*userDataDB); err == nil {
+			fmt.Printf("file: %s\nsize: %d\n", *userDataDB, info.Size())
+		}
+	}
+	fmt.Printf("subjects: %d\nvalues: %d\nversions: %d\npermissions: %d\nsessions: %d\nexpired sessions: %d\ndocuments: %d\n",
+		stats.Subjects, stats.Values, stats.Versions, stats.Permissions, stats.Sessions, stats.ExpiredSessions, stats.Documents)
+	if *storageBackend == "bolt" {
+		fmt.Printf("data keys: %d\n", stats.DataKeys)
+	}
+}
+
+// dbCompactCmd `db compact` rewrite the bolt file, run it with the server stopped
+func dbCompactCmd(args []string) {
+	parseArgs(newFlagSet("db compact", ""), args, 0, 0)
+	if *storageBackend != "bolt" {
+		logrus.Fatalf("db compact supports the bolt storage only, not %s", *storageBackend)
+	}
+	before, after, err := CompactBoltFile(*userDataDB)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	fmt.Printf("file: %s\nbefore: %d\nafter: %d\n", *userDataDB, before, after)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ice2heart/proxyu_client/common"
+	pb "github.com/ice2heart/proxyu_client/serialize"
+)
+
+// openTestStore new empty store, closed when the test ends
+type openTestStore func(t *testing.T) Store
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return NewMemoryStore() })
+}
+
+func TestBoltStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return openTestBoltStore(t, nil)
+	})
+}
+
+func TestBoltStoreEncrypted(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		path := filepath.Join(t.TempDir(), "master.key")
+		if err := ioutil.WriteFile(path, []byte(common.B2S(bytes.Repeat([]byte{7}, 32))+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := LoadKeyring(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return openTestBoltStore(t, keys)
+	})
+}
+
+func openTestBoltStore(t *testing.T, keys *Keyring) Store {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "userdata.db"), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// testStore contract every Store implementation has to keep
+func testStore(t *testing.T, open openTestStore) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s Store)
+	}{
+		{"UserData", testStoreUserData},
+		{"Batch", testStoreBatch},
+		{"Delete", testStoreDelete},
+		{"History", testStoreHistory},
+		{"Retrieved", testStoreRetrieved},
+		{"Permissions", testStorePermissions},
+		{"Sessions", testStoreSessions},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+			tt.test(t, s)
+		})
+	}
+}
+
+func testSubject(b byte) *[32]byte {
+	var subject [32]byte
+	subject[0] = b
+	return &subject
+}
+
+func testData(b byte) *[16]byte {
+	var data [16]byte
+	data[0] = b
+	return &data
+}
+
+func writeTestValue(t *testing.T, s Store, subject *[32]byte, data *[16]byte, value string) {
+	t.Helper()
+	mime := "text/plain"
+	if err := s.WriteUserData(subject, data, &mime, []byte(value), pb.DataSource_LOCAL, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertValue(t *testing.T, s Store, subject *[32]byte, data *[16]byte, want string) {
+	t.Helper()
+	value, mime, err := s.ExtractUserData(subject, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != want || mime != "text/plain" {
+		t.Fatalf("got %q %q, want %q text/plain", value, mime, want)
+	}
+}
+
+func testStoreUserData(t *testing.T, s Store) {
+	subject, other := testSubject(1), testSubject(2)
+	if _, _, err := s.ExtractUserData(subject, testData(1)); !errors.Is(err, ErrDataNotFound) {
+		t.Fatalf("empty store: got %v, want ErrDataNotFound", err)
+	}
+	writeTestValue(t, s, subject, testData(2), "Einstein")
+	writeTestValue(t, s, subject, testData(1), "Albert")
+	writeTestValue(t, s, other, testData(1), "Mileva")
+	writeTestValue(t, s, subject, testData(1), "Albert E.")
+
+	assertValue(t, s, subject, testData(1), "Albert E.")
+	assertValue(t, s, other, testData(1), "Mileva")
+	all, err := s.GetAllUserData(subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].Data != *testData(1) || all[1].Data != *testData(2) {
+		t.Fatalf("GetAllUserData got %v", all)
+	}
+	if string(all[0].Value) != "Albert E." || all[0].Source != pb.DataSource_LOCAL {
+		t.Fatalf("GetAllUserData got %q from %v", all[0].Value, all[0].Source)
+	}
+	if all, _ := s.GetAllUserData(testSubject(3)); len(all) != 0 {
+		t.Fatalf("unknown subject has %d values", len(all))
+	}
+}
+
+func testStoreBatch(t *testing.T, s Store) {
+	subject := testSubject(1)
+	err := s.WriteUserDataBatch([]UserDataWrite{
+		{Subject: *subject, Data: *testData(1), Mime: "text/plain", Value: []byte("Albert"), Source: pb.DataSource_SUPPLY},
+		{Subject: *subject, Data: *testData(2), Mime: "text/plain", Value: []byte("Einstein"), Source: pb.DataSource_SUPPLY},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, s, subject, testData(1), "Albert")
+	assertValue(t, s, subject, testData(2), "Einstein")
+	history, err := s.GetUserDataHistory(subject, testData(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Source != pb.DataSource_SUPPLY {
+		t.Fatalf("history got %v", history)
+	}
+}
+
+func testStoreDelete(t *testing.T, s Store) {
+	subject := testSubject(1)
+	writeTestValue(t, s, subject, testData(1), "Albert")
+	writeTestValue(t, s, subject, testData(1), "Albert E.")
+	writeTestValue(t, s, subject, testData(2), "Einstein")
+
+	if err := s.DeleteUserData(subject, testData(1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.ExtractUserData(subject, testData(1)); !errors.Is(err, ErrDataNotFound) {
+		t.Fatalf("deleted value: got %v, want ErrDataNotFound", err)
+	}
+	if history, _ := s.GetUserDataHistory(subject, testData(1)); len(history) != 0 {
+		t.Fatalf("deleted value has %d versions", len(history))
+	}
+	assertValue(t, s, subject, testData(2), "Einstein")
+	if err := s.DeleteUserData(subject, testData(1)); !errors.Is(err, ErrDataNotFound) {
+		t.Fatalf("second delete: got %v, want ErrDataNotFound", err)
+	}
+}
+
+func testStoreHistory(t *testing.T, s Store) {
+	subject := testSubject(1)
+	process := bytes.Repeat([]byte{9}, 16)
+	writeTestValue(t, s, subject, testData(1), "Albert")
+	mime := "text/plain"
+	if err := s.WriteUserData(subject, testData(1), &mime, []byte("Albert E."), pb.DataSource_SUPPLY, process); err != nil {
+		t.Fatal(err)
+	}
+	history, err := s.GetUserDataHistory(subject, testData(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("got %d versions, want 2", len(history))
+	}
+	first, last := history[0], history[1]
+	if first.Version != 1 || string(first.Value) != "Albert" || first.Source != pb.DataSource_LOCAL {
+		t.Fatalf("first version %+v", first)
+	}
+	if last.Version != 2 || string(last.Value) != "Albert E." || last.Source != pb.DataSource_SUPPLY || !bytes.Equal(last.Process, process) {
+		t.Fatalf("last version %+v", last)
+	}
+
+	// Current versions are kept whatever their age
+	removed, err := s.PruneUserDataHistory(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("pruned %d versions, want 1", removed)
+	}
+	history, _ = s.GetUserDataHistory(subject, testData(1))
+	if len(history) != 1 || history[0].Version != 2 {
+		t.Fatalf("after prune %v", history)
+	}
+	assertValue(t, s, subject, testData(1), "Albert E.")
+}
+
+func testStoreRetrieved(t *testing.T, s Store) {
+	subject, other, now := testSubject(1), testSubject(2), time.Now()
+	process := bytes.Repeat([]byte{9}, 16)
+	writeTestValue(t, s, subject, testData(1), "Albert")
+	err := s.AppendUserDataHistory([]UserDataWrite{
+		{Subject: *subject, Data: *testData(1), Mime: "text/plain", Value: []byte("Albert E."), Source: pb.DataSource_RETRIEVE, Process: process},
+		{Subject: *other, Data: *testData(1), Mime: "text/plain", Value: []byte("Max"), Source: pb.DataSource_RETRIEVE, Process: process},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Retrieved values are no current values
+	assertValue(t, s, subject, testData(1), "Albert")
+	if records, _ := s.GetAllUserData(subject); len(records) != 1 || records[0].Version != 1 {
+		t.Fatalf("current values %+v", records)
+	}
+	if records, _ := s.GetAllUserData(other); len(records) != 0 {
+		t.Fatalf("retrieved value is current: %+v", records)
+	}
+	if _, _, err := s.ExtractUserData(other, testData(1)); !errors.Is(err, ErrDataNotFound) {
+		t.Fatalf("retrieved value: got %v, want ErrDataNotFound", err)
+	}
+	history, _ := s.GetUserDataHistory(subject, testData(1))
+	if len(history) != 2 || history[1].Version != 2 || history[1].Source != pb.DataSource_RETRIEVE || string(history[1].Value) != "Albert E." {
+		t.Fatalf("history %+v", history)
+	}
+
+	// Retrieved versions are kept while the permission runs, other has none
+	if err := s.WritePermission(testPermission(subject, testData(1), now, 0)); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := s.PruneRetrievedHistory(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("erased %d versions, want 1", removed)
+	}
+	if history, _ := s.GetUserDataHistory(other, testData(1)); len(history) != 0 {
+		t.Fatalf("retrieved without permission: %+v", history)
+	}
+	if removed, _ := s.PruneRetrievedHistory(now.Add(2 * time.Hour)); removed != 1 {
+		t.Fatalf("erased %d versions after the permission expired, want 1", removed)
+	}
+	history, _ = s.GetUserDataHistory(subject, testData(1))
+	if len(history) != 1 || history[0].Source != pb.DataSource_LOCAL {
+		t.Fatalf("after erase %+v", history)
+	}
+	assertValue(t, s, subject, testData(1), "Albert")
+}
+
+func testPermission(subject *[32]byte, data *[16]byte, now time.Time, amount uint32) *pb.Permission {
+	return &pb.Permission{
+		PublicKey: subject[:],
+		Data:      data[:],
+		Process:   bytes.Repeat([]byte{9}, 16),
+		From:      uint64(now.Add(-time.Hour).Unix()),
+		Until:     uint64(now.Add(time.Hour).Unix()),
+		Amount:    amount,
+		Remaining: amount,
+		Granted:   now.Unix(),
+	}
+}
+
+func testStorePermissions(t *testing.T, s Store) {
+	subject, now := testSubject(1), time.Now()
+	if _, err := s.UsePermission(subject, testData(1), now); !errors.Is(err, ErrPermissionNotFound) {
+		t.Fatalf("empty store: got %v, want ErrPermissionNotFound", err)
+	}
+	if err := s.WritePermission(testPermission(subject, testData(1), now, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WritePermission(testPermission(subject, testData(2), now, 0)); err != nil {
+		t.Fatal(err)
+	}
+	perms, err := s.GetAllPermissions(subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(perms) != 2 {
+		t.Fatalf("got %d permissions, want 2", len(perms))
+	}
+
+	for want := uint32(1); ; want-- {
+		perm, err := s.UsePermission(subject, testData(1), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm.Remaining != want {
+			t.Fatalf("remaining %d, want %d", perm.Remaining, want)
+		}
+		if want == 0 {
+			break
+		}
+	}
+	if _, err := s.UsePermission(subject, testData(1), now); !errors.Is(err, ErrPermissionExhausted) {
+		t.Fatalf("used up: got %v, want ErrPermissionExhausted", err)
+	}
+	// No limit
+	for i := 0; i < 3; i++ {
+		if _, err := s.UsePermission(subject, testData(2), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.UsePermission(subject, testData(2), now.Add(2*time.Hour)); !errors.Is(err, ErrPermissionExpired) {
+		t.Fatalf("expired: got %v, want ErrPermissionExpired", err)
+	}
+	if _, err := s.UsePermission(subject, testData(2), now.Add(-2*time.Hour)); !errors.Is(err, ErrPermissionNotYetValid) {
+		t.Fatalf("not yet valid: got %v, want ErrPermissionNotYetValid", err)
+	}
+
+	// A new grant replaces the used up one
+	if err := s.WritePermission(testPermission(subject, testData(1), now, 5)); err != nil {
+		t.Fatal(err)
+	}
+	perm, err := s.UsePermission(subject, testData(1), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm.Remaining != 4 {
+		t.Fatalf("remaining %d after a new grant, want 4", perm.Remaining)
+	}
+	if perms, _ := s.GetAllPermissions(testSubject(2)); len(perms) != 0 {
+		t.Fatalf("unknown subject has %d permissions", len(perms))
+	}
+}
+
+func testStoreSessions(t *testing.T, s Store) {
+	user, other := testSubject(1), testSubject(2)
+	now := time.Now()
+	sessions := []struct {
+		id      *[16]byte
+		pubKey  *[32]byte
+		expires time.Time
+	}{
+		{testData(1), user, now.Add(time.Hour)},
+		{testData(2), user, now.Add(-time.Hour)},
+		{testData(3), user, time.Time{}},
+		{testData(4), other, now.Add(time.Hour)},
+	}
+	for _, session := range sessions {
+		if err := s.WriteSession(session.id, session.pubKey, session.expires); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := s.GetSession(testData(1)); !bytes.Equal(got, user[:]) {
+		t.Fatalf("GetSession got %x", got)
+	}
+	if got := s.GetSession(testData(2)); got != nil {
+		t.Fatalf("expired session got %x", got)
+	}
+	if got := s.GetSession(testData(3)); !bytes.Equal(got, user[:]) {
+		t.Fatalf("session without expiry got %x", got)
+	}
+	if got := s.GetSession(testData(9)); got != nil {
+		t.Fatalf("unknown session got %x", got)
+	}
+	if all, err := s.GetSessions(user); err != nil || len(all) != 3 {
+		t.Fatalf("GetSessions got %d sessions, %v", len(all), err)
+	}
+
+	removed, err := s.PurgeExpiredSessions(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("purged %d sessions, want 1", removed)
+	}
+	if err := s.DeleteSession(testData(3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteSession(testData(3)); err != nil {
+		t.Fatalf("deleting a missing session: %v", err)
+	}
+	if got := s.GetSession(testData(3)); got != nil {
+		t.Fatalf("deleted session got %x", got)
+	}
+	removed, err = s.DeleteSessions(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("revoked %d sessions, want 1", removed)
+	}
+	if got := s.GetSession(testData(4)); !bytes.Equal(got, other[:]) {
+		t.Fatal("session of another user was removed")
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	if !sqlDriverRegistered("sqlite3") {
+		t.Skip("sqlite3 driver needs cgo")
+	}
+	testStore(t, func(t *testing.T) Store {
+		store, err := NewSQLStore("sqlite3", "file:"+filepath.Join(t.TempDir(), "userdata.sqlite"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ice2heart/proxyu_client/common"
+	pb "github.com/ice2heart/proxyu_client/protocol"
+	"github.com/sirupsen/logrus"
+	"rsc.io/qr"
+)
+
+// qrQuietZone modules of white border scanners need around the code
+const qrQuietZone = 2
+
+// printQR draw text as QR code with half blocks, two modules per character
+// row. Black on white whatever the colors of the terminal are.
+func printQR(w io.Writer, text string) error {
+	code, err := qr.Encode(text, qr.L)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	for y := -qrQuietZone; y < code.Size+qrQuietZone; y += 2 {
+		b.WriteString("\x1b[30;47m")
+		for x := -qrQuietZone; x < code.Size+qrQuietZone; x++ {
+			top, bottom := code.Black(x, y), code.Black(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\x1b[0m\n")
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// correlateCmd `correlate` identify a data subject in the terminal. The QR
+// codes go to stderr, the base64 public key of the subject to stdout.
+func correlateCmd(args []string) {
+	parseArgs(newFlagSet("correlate", ""), args, 0, 0)
+	conn, err := dialProxyU()
+	if err != nil {
+		logrus.Fatalf("did not connect: %v", err)
+	}
+	defer conn.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	stream, err := pb.NewProxyUIntegrationClient(conn).Correlation(ctx, &pb.CorrelationRequest{})
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			logrus.Fatal("correlation ended without a public key")
+		}
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		switch u := in.GetResponse().(type) {
+		case *pb.CorrelationResponse_CorrelationMessage:
+			fmt.Fprintln(os.Stderr, "Scan the code with the proxyU app:")
+			if err := printQR(os.Stderr, u.CorrelationMessage); err != nil {
+				logrus.Fatal(err)
+			}
+		case *pb.CorrelationResponse_PublicKey:
+			fmt.Println(common.B2S(u.PublicKey))
+			return
+		}
+	}
+}
+
+// requestPermissionCmd `request-permission <pubkey> <data>` ask the subject
+// for a permission in the terminal, the granted permission is stored. Exit
+// status 1 if it is denied.
+func requestPermissionCmd(args []string) {
+	fs := newFlagSet("request-permission", "[flags] <base64 public key> <data>")
+	from := fs.String("from", "", "Unix time the permission starts, now if empty")
+	until := fs.String("until", "", "Unix time the permission ends, by the permission profile if empty")
+	amount := fs.String("amount", "", "Number of retrievals, by the permission profile if empty")
+	level := fs.String("level", "", "Level of the permission, by the permission profile if empty")
+	args = parseArgs(fs, args, 2, 2)
+
+	key := common.S2B(args[0])
+	if len(key) != 32 {
+		logrus.Fatal("public key must be 32 bytes in base64")
+	}
+	var pubKey [32]byte
+	copy(pubKey[:], key)
+	// Data may be a dev name of the didgraph
+	if err := ReloadDAG(); err != nil {
+		logrus.Fatal(err)
+	}
+	dataID, err := ParseDataID(args[1])
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	dataUUID := [16]byte(dataID)
+	profiles, err := ParsePermissionsYML(permissionsyml)
+	if err != nil {
+		logrus.Fatalf("permissions: %v", err)
+	}
+	query := url.Values{}
+	for name, value := range map[string]string{"from": *from, "until": *until, "amount": *amount, "level": *level} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	params, err := profiles.Get(&dataUUID).Params(query, time.Now())
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	store, err := openStore()
+	if err != nil {
+		logrus.Fatalf("storage: %v", err)
+	}
+	defer store.Close()
+	policy, err := CurrentPolicyHash(store)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	conn, err := dialProxyU()
+	if err != nil {
+		logrus.Fatalf("did not connect: %v", err)
+	}
+	defer conn.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	message := newPermissionRequest(&pubKey, &dataUUID, policy, params)
+	stream, err := pb.NewProxyUIntegrationClient(conn).Permission(ctx, message)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			logrus.Fatal("permission request ended without an answer")
+		}
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		switch u := in.GetResponse().(type) {
+		case *pb.PermissionResponse_PermissionMessage:
+			fmt.Fprintln(os.Stderr, "Scan the code with the proxyU app:")
+			if err := printQR(os.Stderr, u.PermissionMessage); err != nil {
+				logrus.Fatal(err)
+			}
+		case *pb.PermissionResponse_Granted:
+			if !u.Granted {
+				fmt.Println("denied")
+				store.Close()
+				os.Exit(1)
+			}
+			if err := store.WritePermission(grantedPermission(message, time.Now())); err != nil {
+				logrus.Fatalf("store permission: %v", err)
+			}
+			fmt.Printf("granted\ndata: %v\nfrom: %d\nuntil: %d\namount: %d\n", dataID, message.From, message.Until, message.Amount)
+			return
+		}
+	}
+}